@@ -205,27 +205,75 @@ func validateJWT(tokenString string) (*Claims, error) {
 
 func authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			c.Abort()
+		if !authenticate(c) {
 			return
 		}
+		c.Next()
+	}
+}
+
+// authenticate validates the bearer JWT and stores the user in the context,
+// aborting the request when it is missing or invalid.
+func authenticate(c *gin.Context) bool {
+	authHeader := c.GetHeader("Authorization")
+	if authHeader == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+		c.Abort()
+		return false
+	}
+
+	tokenString := authHeader
+	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
+		tokenString = authHeader[7:]
+	}
+
+	claims, err := validateJWT(tokenString)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.Abort()
+		return false
+	}
+
+	c.Set("user_email", claims.Email)
+	c.Set("user_id", claims.UserID)
+	return true
+}
 
-		tokenString := authHeader
-		if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-			tokenString = authHeader[7:]
+// adminMiddleware guards the runtime configuration API. Requests are allowed
+// with an X-Admin-Token matching ADMIN_TOKEN, or with a user JWT when the
+// user is an admin. Everyone else is refused.
+func adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminToken := getEnv("ADMIN_TOKEN", "")
+		if adminToken != "" && c.GetHeader("X-Admin-Token") == adminToken {
+			c.Next()
+			return
 		}
 
-		claims, err := validateJWT(tokenString)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
+		if !authenticate(c) {
 			return
 		}
 
-		c.Set("user_email", claims.Email)
-		c.Set("user_id", claims.UserID)
-		c.Next()
+		if isAdmin(c.GetString("user_email")) {
+			c.Next()
+			return
+		}
+
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+		c.Abort()
+	}
+}
+
+// isAdmin tells whether a user is listed in ADMIN_EMAILS. With
+// ADMIN_OPEN=true every logged-in user is an admin.
+func isAdmin(userEmail string) bool {
+	if getEnv("ADMIN_OPEN", "false") == "true" {
+		return true
+	}
+	for _, email := range strings.Split(getEnv("ADMIN_EMAILS", ""), ",") {
+		if email = strings.TrimSpace(email); email != "" && strings.EqualFold(email, userEmail) {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,157 @@
+package mockmt
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	dmarcPass      = "pass"
+	dmarcFail      = "fail"
+	dmarcNone      = "none"
+	dmarcTempError = "temperror"
+	dmarcPermError = "permerror"
+)
+
+// Authentication is the SPF and DMARC verdict of a message, evaluated against
+// the DNS override table. Results is the equivalent Authentication-Results
+// header, which also carries the DKIM results.
+type Authentication struct {
+	SPF         string `json:"spf"`
+	SPFDomain   string `json:"spf_domain"`
+	SPFReason   string `json:"spf_reason,omitempty"`
+	FromDomain  string `json:"from_domain"`
+	DMARC       string `json:"dmarc"`
+	DMARCPolicy string `json:"dmarc_policy,omitempty"`
+	DMARCReason string `json:"dmarc_reason,omitempty"`
+	Results     string `json:"authentication_results"`
+}
+
+// checkAuthentication evaluates SPF for the client IP and envelope sender,
+// then DMARC alignment of the header From domain with the SPF and DKIM
+// domains.
+func checkAuthentication(clientIP, helo, mailFrom string, headerFrom []Address, dkimResults []DKIMResult) *Authentication {
+	a := &Authentication{SPFDomain: addressDomain(mailFrom)}
+	if mailFrom == "" {
+		a.SPFDomain = helo
+	}
+
+	result, err := spf.CheckHostWithSender(net.ParseIP(clientIP), helo, mailFrom, spf.WithResolver(dnsResolver{}))
+	a.SPF = string(result)
+	if err != nil && result != spf.Pass {
+		a.SPFReason = err.Error()
+	}
+
+	if len(headerFrom) > 0 {
+		a.FromDomain = strings.ToLower(addressDomain(headerFrom[0].Address))
+	}
+	a.DMARC, a.DMARCPolicy, a.DMARCReason = evaluateDMARC(a.FromDomain, a.SPF, a.SPFDomain, dkimResults)
+
+	results := []authres.Result{&authres.SPFResult{
+		Value:  authres.ResultValue(a.SPF),
+		Reason: a.SPFReason,
+		From:   mailFrom,
+		Helo:   helo,
+	}}
+	for _, r := range dkimResults {
+		results = append(results, &authres.DKIMResult{
+			Value:  authres.ResultValue(r.Result),
+			Reason: r.Reason,
+			Domain: r.Domain,
+		})
+	}
+	results = append(results, &authres.DMARCResult{
+		Value:  authres.ResultValue(a.DMARC),
+		Reason: a.DMARCReason,
+		From:   a.FromDomain,
+	})
+	a.Results = authres.Format(smtpDomain, results)
+
+	return a
+}
+
+// evaluateDMARC looks up the policy of the From domain, or else of its
+// organizational domain, and checks that SPF or a DKIM signature passed for
+// an aligned domain.
+func evaluateDMARC(fromDomain, spfResult, spfDomain string, dkimResults []DKIMResult) (result, policy, reason string) {
+	if fromDomain == "" {
+		return dmarcNone, "", "no From domain"
+	}
+
+	options := &dmarc.LookupOptions{LookupTXT: lookupTXT}
+	record, err := dmarc.LookupWithOptions(fromDomain, options)
+	orgDomain := organizationalDomain(fromDomain)
+	inherited := false
+	if errors.Is(err, dmarc.ErrNoPolicy) && orgDomain != fromDomain {
+		record, err = dmarc.LookupWithOptions(orgDomain, options)
+		inherited = true
+	}
+	switch {
+	case errors.Is(err, dmarc.ErrNoPolicy):
+		return dmarcNone, "", "no DMARC record for " + fromDomain
+	case dmarc.IsTempFail(err):
+		return dmarcTempError, "", err.Error()
+	case err != nil:
+		return dmarcPermError, "", err.Error()
+	}
+
+	policy = string(record.Policy)
+	if inherited && record.SubdomainPolicy != "" {
+		policy = string(record.SubdomainPolicy)
+	}
+
+	if spfResult == string(spf.Pass) && domainsAligned(spfDomain, fromDomain, record.SPFAlignment) {
+		return dmarcPass, policy, "SPF aligned with " + spfDomain
+	}
+	for _, r := range dkimResults {
+		if r.Result == dkimPass && domainsAligned(r.Domain, fromDomain, record.DKIMAlignment) {
+			return dmarcPass, policy, "DKIM aligned with " + r.Domain
+		}
+	}
+	return dmarcFail, policy, fmt.Sprintf("neither SPF nor DKIM passed for a domain aligned with %s", fromDomain)
+}
+
+// domainsAligned compares domains exactly in strict mode and by their
+// organizational domain in relaxed mode.
+func domainsAligned(domain, fromDomain string, mode dmarc.AlignmentMode) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+	if mode == dmarc.AlignmentStrict {
+		return domain == fromDomain
+	}
+	return organizationalDomain(domain) == organizationalDomain(fromDomain)
+}
+
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+func getAuthentication(emailID int) (*Authentication, error) {
+	var a Authentication
+	err := db.QueryRow(`
+		SELECT spf, spf_domain, spf_reason, from_domain, dmarc, dmarc_policy, dmarc_reason, results
+		FROM email_authentication
+		WHERE email_id = ?
+	`, emailID).Scan(&a.SPF, &a.SPFDomain, &a.SPFReason, &a.FromDomain, &a.DMARC, &a.DMARCPolicy, &a.DMARCReason, &a.Results)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
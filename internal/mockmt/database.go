@@ -2,7 +2,9 @@ package mockmt
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -19,16 +21,68 @@ type User struct {
 }
 
 type Email struct {
-	ID         int       `json:"id"`
-	MessageID  string    `json:"message_id"`
-	FromEmail  string    `json:"from_email"`
-	ToEmail    string    `json:"to_email"`
-	Subject    string    `json:"subject"`
-	Body       string    `json:"body"`
-	HTMLBody   string    `json:"html_body"`
-	ReceivedAt time.Time `json:"received_at"`
-	IsDeleted  bool      `json:"is_deleted"`
-	UserID     int       `json:"user_id"`
+	ID                int             `json:"id"`
+	MessageID         string          `json:"message_id"`
+	OriginalMessageID string          `json:"original_message_id"`
+	FromEmail         string          `json:"from_email"`
+	ToEmail           string          `json:"to_email"`
+	Subject           string          `json:"subject"`
+	Body              string          `json:"body"`
+	BodyDerived       bool            `json:"body_derived"`
+	HTMLBody          string          `json:"html_body"`
+	ReceivedAt        time.Time       `json:"received_at"`
+	IsDeleted         bool            `json:"is_deleted"`
+	UserID            int             `json:"user_id"`
+	AuthUser          string          `json:"auth_user"`
+	ClientIP          string          `json:"client_ip,omitempty"`
+	IsBcc             bool            `json:"is_bcc"`
+	IsRead            bool            `json:"is_read"`
+	SMTPExtensions    []string        `json:"smtp_extensions,omitempty"`
+	Charset           string          `json:"charset,omitempty"`
+	TranscriptID      int             `json:"transcript_id,omitempty"`
+	Envelope          *Envelope       `json:"envelope,omitempty"`
+	HeaderFrom        []Address       `json:"header_from,omitempty"`
+	HeaderTo          []Address       `json:"header_to,omitempty"`
+	HeaderCc          []Address       `json:"header_cc,omitempty"`
+	HeaderReplyTo     []Address       `json:"header_reply_to,omitempty"`
+	Bcc               []string        `json:"bcc,omitempty"`
+	Attachments       []Attachment    `json:"attachments,omitempty"`
+	Deliveries        []Delivery      `json:"deliveries,omitempty"`
+	DKIM              []DKIMResult    `json:"dkim,omitempty"`
+	Authentication    *Authentication `json:"authentication,omitempty"`
+	Headers           []EmailHeader   `json:"-"`
+	Parts             *MIMEPart       `json:"-"`
+	Inboxes           []string        `json:"-"`
+	TranscriptPos     int             `json:"-"` // position of the transaction's MAIL command
+	Raw               []byte          `json:"-"`
+}
+
+// Envelope is what the client said in the SMTP dialogue, as opposed to the
+// addresses written in the message headers.
+type Envelope struct {
+	MailFrom string   `json:"mail_from"`
+	RcptTo   []string `json:"rcpt_to"`
+}
+
+type Address struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+type EmailHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type Attachment struct {
+	ID          int    `json:"id"`
+	EmailID     int    `json:"email_id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	ContentID   string `json:"content_id"`
+	Disposition string `json:"disposition"`
+	Data        []byte `json:"-"`
 }
 
 func InitDatabase() error {
@@ -76,6 +130,176 @@ func createTables() error {
 			received_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			is_deleted BOOLEAN DEFAULT FALSE,
 			user_id INTEGER,
+			raw BLOB,
+			original_message_id TEXT,
+			is_bcc BOOLEAN DEFAULT FALSE,
+			auth_user TEXT,
+			smtp_extensions TEXT,
+			charset TEXT,
+			body_derived BOOLEAN DEFAULT FALSE,
+			transcript_id INTEGER,
+			client_ip TEXT,
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Attachments table
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS attachments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email_id INTEGER NOT NULL,
+			filename TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			content_id TEXT,
+			disposition TEXT,
+			data BLOB,
+			FOREIGN KEY (email_id) REFERENCES emails (id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Headers table, one row per header field in original order
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS email_headers (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			value TEXT NOT NULL,
+			FOREIGN KEY (email_id) REFERENCES emails (id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Addresses table, covering envelope recipients and header address lists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS email_addresses (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email_id INTEGER NOT NULL,
+			field TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			address TEXT NOT NULL,
+			FOREIGN KEY (email_id) REFERENCES emails (id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// DKIM results table, one row per signature in header order
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS dkim_results (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			domain TEXT NOT NULL,
+			selector TEXT NOT NULL,
+			identifier TEXT NOT NULL,
+			result TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			FOREIGN KEY (email_id) REFERENCES emails (id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// SPF and DMARC verdict of each message
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS email_authentication (
+			email_id INTEGER PRIMARY KEY,
+			spf TEXT NOT NULL,
+			spf_domain TEXT NOT NULL,
+			spf_reason TEXT NOT NULL,
+			from_domain TEXT NOT NULL,
+			dmarc TEXT NOT NULL,
+			dmarc_policy TEXT NOT NULL,
+			dmarc_reason TEXT NOT NULL,
+			results TEXT NOT NULL,
+			FOREIGN KEY (email_id) REFERENCES emails (id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// MIME parts table, the part tree of each message in pre-order
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS email_parts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			path TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			charset TEXT,
+			encoding TEXT,
+			disposition TEXT,
+			filename TEXT,
+			content_id TEXT,
+			subject TEXT,
+			size INTEGER NOT NULL,
+			attachment_id INTEGER,
+			FOREIGN KEY (email_id) REFERENCES emails (id),
+			FOREIGN KEY (attachment_id) REFERENCES attachments (id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Recipients table, one row per inbox a stored message was delivered to
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS email_recipients (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			to_email TEXT NOT NULL,
+			is_bcc BOOLEAN DEFAULT FALSE,
+			is_deleted BOOLEAN DEFAULT FALSE,
+			is_read BOOLEAN DEFAULT FALSE,
+			UNIQUE (email_id, user_id),
+			FOREIGN KEY (email_id) REFERENCES emails (id),
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Greylist table, one row per (client IP, MAIL FROM, RCPT TO) triplet
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS greylist (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			client_ip TEXT NOT NULL,
+			mail_from TEXT NOT NULL,
+			rcpt_to TEXT NOT NULL,
+			first_seen DATETIME NOT NULL,
+			attempts INTEGER DEFAULT 1,
+			passed_at DATETIME,
+			UNIQUE (client_ip, mail_from, rcpt_to)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// SMTP credentials table for enforced SMTP AUTH
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS smtp_credentials (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			username TEXT UNIQUE NOT NULL,
+			password TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY (user_id) REFERENCES users (id)
 		)
 	`)
@@ -83,6 +307,93 @@ func createTables() error {
 		return err
 	}
 
+	// Relay deliveries table, one row per attempt to send a message upstream
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS relay_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email_id INTEGER NOT NULL,
+			rcpt_to TEXT NOT NULL,
+			status TEXT NOT NULL,
+			error TEXT,
+			automatic BOOLEAN DEFAULT FALSE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (email_id) REFERENCES emails (id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// SMTP transcripts, one row per client connection and one per line of
+	// its dialogue
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS smtp_transcripts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			listener TEXT NOT NULL,
+			client_ip TEXT NOT NULL,
+			helo TEXT,
+			extensions TEXT,
+			tls_version TEXT,
+			tls_cipher TEXT,
+			tls_server_name TEXT,
+			started_at DATETIME NOT NULL,
+			ended_at DATETIME
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS smtp_transcript_lines (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			transcript_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			offset_ms INTEGER NOT NULL,
+			direction TEXT NOT NULL,
+			text TEXT NOT NULL,
+			FOREIGN KEY (transcript_id) REFERENCES smtp_transcripts (id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Columns added after the initial schema
+	if err := addColumnIfMissing("emails", "raw", "BLOB"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("emails", "original_message_id", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("emails", "is_bcc", "BOOLEAN DEFAULT FALSE"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("emails", "auth_user", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("emails", "smtp_extensions", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("emails", "charset", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("emails", "body_derived", "BOOLEAN DEFAULT FALSE"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("emails", "transcript_id", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("emails", "transcript_position", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("emails", "client_ip", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("email_recipients", "is_read", "BOOLEAN DEFAULT FALSE"); err != nil {
+		return err
+	}
+
 	// Create indexes
 	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_emails_to_email ON emails (to_email)`)
 	if err != nil {
@@ -99,7 +410,95 @@ func createTables() error {
 		return err
 	}
 
-	return nil
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_attachments_email_id ON attachments (email_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_email_headers_email_id ON email_headers (email_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_email_addresses_email_id ON email_addresses (email_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_email_parts_email_id ON email_parts (email_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_dkim_results_email_id ON dkim_results (email_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_relay_deliveries_email_id ON relay_deliveries (email_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_emails_transcript_id ON emails (transcript_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_smtp_transcript_lines_transcript_id ON smtp_transcript_lines (transcript_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_email_recipients_user_id ON email_recipients (user_id, is_deleted)`)
+	if err != nil {
+		return err
+	}
+
+	// Emails stored before the recipients table existed carry their single
+	// recipient on the emails row itself
+	_, err = db.Exec(`
+		INSERT INTO email_recipients (email_id, user_id, to_email, is_bcc, is_deleted)
+		SELECT id, user_id, to_email, COALESCE(is_bcc, FALSE), is_deleted
+		FROM emails
+		WHERE user_id IS NOT NULL AND id NOT IN (SELECT email_id FROM email_recipients)
+	`)
+	if err != nil {
+		return err
+	}
+
+	return createSearchIndex()
+}
+
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   bool
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
 }
 
 func createOrGetUser(email, name, picture string) (*User, error) {
@@ -132,73 +531,359 @@ func createOrGetUser(email, name, picture string) (*User, error) {
 	}, nil
 }
 
-func saveEmail(fromEmail, toEmail, subject, body, htmlBody string) error {
-	// Get or create user for recipient
-	user, err := createOrGetUser(toEmail, toEmail, "")
-	if err != nil {
-		return err
+// saveEmail stores a message once and delivers it to the inbox of every
+// envelope recipient. Inboxes, when set, holds the routed inbox of each
+// recipient in Envelope.RcptTo.
+func saveEmail(email *Email) error {
+	// Get or create users for recipients before starting the transaction
+	users := []*User{}
+	for i, rcpt := range email.Envelope.RcptTo {
+		inbox := rcpt
+		if i < len(email.Inboxes) {
+			inbox = email.Inboxes[i]
+		}
+		user, err := createOrGetUser(inbox, inbox, "")
+		if err != nil {
+			return err
+		}
+		users = append(users, user)
 	}
 
 	// Generate message ID
 	messageID := generateMessageID()
 
-	_, err = db.Exec(`
-		INSERT INTO emails (message_id, from_email, to_email, subject, body, html_body, user_id)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, messageID, fromEmail, toEmail, subject, body, htmlBody, user.ID)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	return err
-}
+	var transcriptID, transcriptPosition any
+	if email.TranscriptID > 0 {
+		transcriptID, transcriptPosition = email.TranscriptID, email.TranscriptPos
+	}
+	result, err := tx.Exec(`
+		INSERT INTO emails (message_id, original_message_id, from_email, to_email, subject, body, html_body, raw, auth_user, smtp_extensions, charset, body_derived, transcript_id, transcript_position, client_ip)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, messageID, email.OriginalMessageID, email.FromEmail, strings.Join(email.Envelope.RcptTo, ", "), email.Subject, email.Body, email.HTMLBody, email.Raw, email.AuthUser, strings.Join(email.SMTPExtensions, ","), email.Charset, email.BodyDerived, transcriptID, transcriptPosition, email.ClientIP)
+	if err != nil {
+		return err
+	}
 
-func getEmailsByUser(userID int) ([]Email, error) {
-	rows, err := db.Query(`
-		SELECT id, message_id, from_email, to_email, subject, body, html_body, received_at, is_deleted, user_id
-		FROM emails 
-		WHERE user_id = ? AND is_deleted = FALSE 
-		ORDER BY received_at DESC
-	`, userID)
+	emailID, err := result.LastInsertId()
 	if err != nil {
-		return []Email{}, err
+		return err
 	}
-	defer rows.Close()
+	email.ID = int(emailID)
+	email.MessageID = messageID
 
-	emails := []Email{}
-	for rows.Next() {
-		var email Email
-		err := rows.Scan(
-			&email.ID, &email.MessageID, &email.FromEmail, &email.ToEmail,
-			&email.Subject, &email.Body, &email.HTMLBody, &email.ReceivedAt,
-			&email.IsDeleted, &email.UserID,
-		)
+	for i, user := range users {
+		rcpt := email.Envelope.RcptTo[i]
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO email_recipients (email_id, user_id, to_email, is_bcc)
+			VALUES (?, ?, ?, ?)
+		`, emailID, user.ID, rcpt, containsAddress(email.Bcc, rcpt))
 		if err != nil {
-			return nil, err
+			return err
+		}
+	}
+
+	for i, a := range email.Attachments {
+		result, err := tx.Exec(`
+			INSERT INTO attachments (email_id, filename, content_type, size, content_id, disposition, data)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, emailID, a.Filename, a.ContentType, len(a.Data), a.ContentID, a.Disposition, a.Data)
+		if err != nil {
+			return err
+		}
+		attachmentID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		email.Attachments[i].ID = int(attachmentID)
+		email.Attachments[i].EmailID = email.ID
+	}
+
+	if email.Parts != nil {
+		for i, part := range flattenParts(*email.Parts) {
+			var attachmentID any
+			if part.attachment > 0 {
+				attachmentID = email.Attachments[part.attachment-1].ID
+			}
+			_, err = tx.Exec(`
+				INSERT INTO email_parts (email_id, position, path, content_type, charset, encoding, disposition, filename, content_id, subject, size, attachment_id)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`, emailID, i, part.Path, part.ContentType, part.Charset, part.Encoding, part.Disposition, part.Filename, part.ContentID, part.Subject, part.Size, attachmentID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, r := range email.DKIM {
+		_, err = tx.Exec(`
+			INSERT INTO dkim_results (email_id, position, domain, selector, identifier, result, reason)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, emailID, i, r.Domain, r.Selector, r.Identifier, r.Result, r.Reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a := email.Authentication; a != nil {
+		_, err = tx.Exec(`
+			INSERT INTO email_authentication (email_id, spf, spf_domain, spf_reason, from_domain, dmarc, dmarc_policy, dmarc_reason, results)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, emailID, a.SPF, a.SPFDomain, a.SPFReason, a.FromDomain, a.DMARC, a.DMARCPolicy, a.DMARCReason, a.Results)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, h := range email.Headers {
+		_, err = tx.Exec(`
+			INSERT INTO email_headers (email_id, position, name, value)
+			VALUES (?, ?, ?, ?)
+		`, emailID, i, h.Name, h.Value)
+		if err != nil {
+			return err
 		}
-		emails = append(emails, email)
 	}
 
-	return emails, nil
+	addressLists := map[string][]Address{
+		"from":     email.HeaderFrom,
+		"to":       email.HeaderTo,
+		"cc":       email.HeaderCc,
+		"reply-to": email.HeaderReplyTo,
+	}
+	for _, rcpt := range email.Envelope.RcptTo {
+		addressLists["rcpt-to"] = append(addressLists["rcpt-to"], Address{Address: rcpt})
+	}
+	for field, addresses := range addressLists {
+		for i, a := range addresses {
+			_, err = tx.Exec(`
+				INSERT INTO email_addresses (email_id, field, position, name, address)
+				VALUES (?, ?, ?, ?, ?)
+			`, emailID, field, i, a.Name, a.Address)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := indexEmail(tx, email); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func getEmailByID(emailID, userID int) (*Email, error) {
 	var email Email
+	var extensions string
 	err := db.QueryRow(`
-		SELECT id, message_id, from_email, to_email, subject, body, html_body, received_at, is_deleted, user_id
-		FROM emails 
-		WHERE id = ? AND user_id = ? AND is_deleted = FALSE
+		SELECT e.id, e.message_id, COALESCE(e.original_message_id, ''), e.from_email, r.to_email, e.subject, e.body, e.html_body, e.received_at, r.is_deleted, r.user_id, COALESCE(e.auth_user, ''), r.is_bcc, COALESCE(e.smtp_extensions, ''), COALESCE(e.charset, ''), COALESCE(e.body_derived, FALSE), COALESCE(e.transcript_id, 0), COALESCE(e.client_ip, ''), COALESCE(r.is_read, FALSE)
+		FROM email_recipients r
+		JOIN emails e ON e.id = r.email_id
+		WHERE r.email_id = ? AND r.user_id = ? AND r.is_deleted = FALSE
 	`, emailID, userID).Scan(
-		&email.ID, &email.MessageID, &email.FromEmail, &email.ToEmail,
+		&email.ID, &email.MessageID, &email.OriginalMessageID, &email.FromEmail, &email.ToEmail,
 		&email.Subject, &email.Body, &email.HTMLBody, &email.ReceivedAt,
-		&email.IsDeleted, &email.UserID,
+		&email.IsDeleted, &email.UserID, &email.AuthUser, &email.IsBcc, &extensions, &email.Charset, &email.BodyDerived, &email.TranscriptID, &email.ClientIP, &email.IsRead,
 	)
 	if err != nil {
 		return nil, err
 	}
+	if extensions != "" {
+		email.SMTPExtensions = strings.Split(extensions, ",")
+	}
+
+	email.Attachments, err = getAttachmentsByEmail(email.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadEmailAddresses(&email); err != nil {
+		return nil, err
+	}
+
+	email.Deliveries, err = getDeliveriesByEmail(email.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	email.DKIM, err = getDKIMResults(email.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	email.Authentication, err = getAuthentication(email.ID)
+	if err != nil {
+		return nil, err
+	}
 
 	return &email, nil
 }
 
+func loadEmailAddresses(email *Email) error {
+	rows, err := db.Query(`
+		SELECT field, name, address
+		FROM email_addresses
+		WHERE email_id = ?
+		ORDER BY field, position
+	`, email.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	email.Envelope = &Envelope{MailFrom: email.FromEmail, RcptTo: []string{}}
+	for rows.Next() {
+		var field string
+		var a Address
+		if err := rows.Scan(&field, &a.Name, &a.Address); err != nil {
+			return err
+		}
+		switch field {
+		case "from":
+			email.HeaderFrom = append(email.HeaderFrom, a)
+		case "to":
+			email.HeaderTo = append(email.HeaderTo, a)
+		case "cc":
+			email.HeaderCc = append(email.HeaderCc, a)
+		case "reply-to":
+			email.HeaderReplyTo = append(email.HeaderReplyTo, a)
+		case "rcpt-to":
+			email.Envelope.RcptTo = append(email.Envelope.RcptTo, a.Address)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	email.Bcc = bccRecipients(email.Envelope.RcptTo, email.HeaderTo, email.HeaderCc)
+	return nil
+}
+
+func getAttachmentsByEmail(emailID int) ([]Attachment, error) {
+	rows, err := db.Query(`
+		SELECT id, email_id, filename, content_type, size, content_id, disposition
+		FROM attachments
+		WHERE email_id = ?
+		ORDER BY id
+	`, emailID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		err := rows.Scan(&a.ID, &a.EmailID, &a.Filename, &a.ContentType, &a.Size, &a.ContentID, &a.Disposition)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+
+	return attachments, nil
+}
+
+func getEmailHeaders(emailID, userID int) ([]EmailHeader, error) {
+	rows, err := db.Query(`
+		SELECT h.name, h.value
+		FROM email_headers h
+		JOIN email_recipients r ON r.email_id = h.email_id
+		WHERE h.email_id = ? AND r.user_id = ? AND r.is_deleted = FALSE
+		ORDER BY h.position
+	`, emailID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	headers := []EmailHeader{}
+	for rows.Next() {
+		var h EmailHeader
+		if err := rows.Scan(&h.Name, &h.Value); err != nil {
+			return nil, err
+		}
+		headers = append(headers, h)
+	}
+
+	return headers, nil
+}
+
+// getEmailParts returns the stored MIME tree, or nil for messages received
+// before parts were recorded.
+func getEmailParts(emailID, userID int) (*MIMEPart, error) {
+	rows, err := db.Query(`
+		SELECT p.path, p.content_type, COALESCE(p.charset, ''), COALESCE(p.encoding, ''), COALESCE(p.disposition, ''),
+			COALESCE(p.filename, ''), COALESCE(p.content_id, ''), COALESCE(p.subject, ''), p.size, COALESCE(p.attachment_id, 0)
+		FROM email_parts p
+		JOIN email_recipients r ON r.email_id = p.email_id
+		WHERE p.email_id = ? AND r.user_id = ? AND r.is_deleted = FALSE
+		ORDER BY p.position
+	`, emailID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parts := []MIMEPart{}
+	for rows.Next() {
+		var p MIMEPart
+		err := rows.Scan(&p.Path, &p.ContentType, &p.Charset, &p.Encoding, &p.Disposition,
+			&p.Filename, &p.ContentID, &p.Subject, &p.Size, &p.AttachmentID)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+
+	return buildPartTree(parts), nil
+}
+
+func getAttachment(attachmentID, emailID, userID int) (*Attachment, error) {
+	var a Attachment
+	err := db.QueryRow(`
+		SELECT a.id, a.email_id, a.filename, a.content_type, a.size, a.content_id, a.disposition, a.data
+		FROM attachments a
+		JOIN email_recipients r ON r.email_id = a.email_id
+		WHERE a.id = ? AND a.email_id = ? AND r.user_id = ? AND r.is_deleted = FALSE
+	`, attachmentID, emailID, userID).Scan(
+		&a.ID, &a.EmailID, &a.Filename, &a.ContentType, &a.Size, &a.ContentID, &a.Disposition, &a.Data,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+func getEmailRaw(emailID, userID int) ([]byte, error) {
+	var raw []byte
+	err := db.QueryRow(`
+		SELECT e.raw
+		FROM emails e
+		JOIN email_recipients r ON r.email_id = e.id
+		WHERE e.id = ? AND r.user_id = ? AND r.is_deleted = FALSE
+	`, emailID, userID).Scan(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return raw, nil
+}
+
 func deleteEmail(emailID, userID int) error {
-	_, err := db.Exec("UPDATE emails SET is_deleted = TRUE WHERE id = ? AND user_id = ?", emailID, userID)
+	_, err := db.Exec("UPDATE email_recipients SET is_deleted = TRUE WHERE email_id = ? AND user_id = ?", emailID, userID)
+	return err
+}
+
+func markEmailRead(emailID, userID int) error {
+	_, err := db.Exec("UPDATE email_recipients SET is_read = TRUE WHERE email_id = ? AND user_id = ?", emailID, userID)
 	return err
 }
 
@@ -214,6 +899,6 @@ func getUserByEmail(email string) (*User, error) {
 
 func getEmailStats(userID int) (int, error) {
 	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM emails WHERE user_id = ? AND is_deleted = FALSE", userID).Scan(&count)
+	err := db.QueryRow("SELECT COUNT(*) FROM email_recipients WHERE user_id = ? AND is_deleted = FALSE", userID).Scan(&count)
 	return count, err
 }
@@ -0,0 +1,109 @@
+package mockmt
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+const (
+	dkimPass      = "pass"
+	dkimFail      = "fail"
+	dkimTempError = "temperror"
+	dkimPermError = "permerror"
+
+	// Signatures beyond this are not verified
+	maxDKIMSignatures = 10
+)
+
+// DKIMResult is the outcome of verifying one DKIM-Signature header, listed in
+// the order the headers appear in the message. Reason explains any result
+// other than pass.
+type DKIMResult struct {
+	Domain     string `json:"domain"`
+	Selector   string `json:"selector"`
+	Identifier string `json:"identifier,omitempty"`
+	Result     string `json:"result"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// verifyDKIM checks the signatures of a raw message, with keys looked up in
+// the DNS override table.
+func verifyDKIM(raw []byte, h message.Header) []DKIMResult {
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{
+		LookupTXT:        lookupTXT,
+		MaxVerifications: maxDKIMSignatures,
+	})
+	if err != nil && !errors.Is(err, dkim.ErrTooManySignatures) {
+		log.Printf("Error verifying DKIM signatures: %v", err)
+		return nil
+	}
+
+	signatures := h.Values("DKIM-Signature")
+	results := []DKIMResult{}
+	for i, v := range verifications {
+		result := DKIMResult{
+			Domain:     v.Domain,
+			Identifier: v.Identifier,
+			Result:     dkimPass,
+		}
+		if i < len(signatures) {
+			result.Selector = dkimTag(signatures[i], "s")
+		}
+
+		switch {
+		case v.Err == nil:
+		case dkim.IsTempFail(v.Err):
+			result.Result = dkimTempError
+		case dkim.IsPermFail(v.Err):
+			result.Result = dkimPermError
+		default:
+			result.Result = dkimFail
+		}
+		if v.Err != nil {
+			result.Reason = strings.TrimPrefix(v.Err.Error(), "dkim: ")
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// dkimTag returns the value of one tag of a DKIM-Signature header.
+func dkimTag(signature, name string) string {
+	for _, tag := range strings.Split(signature, ";") {
+		key, value, ok := strings.Cut(tag, "=")
+		if ok && strings.TrimSpace(key) == name {
+			return strings.Join(strings.Fields(value), "")
+		}
+	}
+	return ""
+}
+
+func getDKIMResults(emailID int) ([]DKIMResult, error) {
+	rows, err := db.Query(`
+		SELECT domain, selector, identifier, result, reason
+		FROM dkim_results
+		WHERE email_id = ?
+		ORDER BY position
+	`, emailID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []DKIMResult{}
+	for rows.Next() {
+		var r DKIMResult
+		if err := rows.Scan(&r.Domain, &r.Selector, &r.Identifier, &r.Result, &r.Reason); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+
+	return results, nil
+}
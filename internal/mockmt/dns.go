@@ -0,0 +1,407 @@
+package mockmt
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DNSRecord is an entry of the local DNS override table that message
+// authentication checks resolve against, such as the TXT record of a DKIM
+// key at selector._domainkey.example.com. Type is TXT, A, AAAA or MX, with MX
+// values written as "10 mx.example.com".
+type DNSRecord struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+var (
+	dnsMu      sync.Mutex
+	dnsRecords []*DNSRecord
+	dnsNextID  = 1
+)
+
+// loadDNSRecords reads the initial override table from DNS_ZONE_FILE (a
+// zone file), DNS_RECORDS_FILE (a JSON array) and DNS_RECORDS (the same JSON
+// inline).
+func loadDNSRecords() error {
+	var records []DNSRecord
+	if path := getEnv("DNS_ZONE_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read DNS_ZONE_FILE: %w", err)
+		}
+		records, err = parseZone(string(data))
+		if err != nil {
+			return fmt.Errorf("failed to parse DNS_ZONE_FILE: %w", err)
+		}
+	}
+
+	more, err := loadRulesFromEnv[DNSRecord]("DNS_RECORDS_FILE", "DNS_RECORDS")
+	if err != nil {
+		return err
+	}
+	records = append(records, more...)
+
+	for _, record := range records {
+		if _, err := addDNSRecord(record); err != nil {
+			return err
+		}
+	}
+	if len(records) > 0 {
+		log.Printf("Loaded %d DNS override records", len(records))
+	}
+	return nil
+}
+
+func addDNSRecord(record DNSRecord) (*DNSRecord, error) {
+	record.Name = dnsName(record.Name)
+	if record.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	record.Type = strings.ToUpper(record.Type)
+	if record.Type == "" {
+		record.Type = "TXT"
+	}
+	record.Value = strings.TrimSpace(record.Value)
+	switch record.Type {
+	case "TXT":
+	case "A", "AAAA":
+		ip := net.ParseIP(record.Value)
+		if ip == nil || (ip.To4() != nil) != (record.Type == "A") {
+			return nil, fmt.Errorf("invalid %s address %q", record.Type, record.Value)
+		}
+	case "MX":
+		if _, err := parseMX(record.Value); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported record type %q", record.Type)
+	}
+
+	dnsMu.Lock()
+	defer dnsMu.Unlock()
+
+	record.ID = dnsNextID
+	dnsNextID++
+	dnsRecords = append(dnsRecords, &record)
+	created := record
+	return &created, nil
+}
+
+func listDNSRecords() []DNSRecord {
+	dnsMu.Lock()
+	defer dnsMu.Unlock()
+
+	records := []DNSRecord{}
+	for _, record := range dnsRecords {
+		records = append(records, *record)
+	}
+	return records
+}
+
+func deleteDNSRecord(id int) bool {
+	dnsMu.Lock()
+	defer dnsMu.Unlock()
+
+	for i, record := range dnsRecords {
+		if record.ID == id {
+			dnsRecords = append(dnsRecords[:i], dnsRecords[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func clearDNSRecords() {
+	dnsMu.Lock()
+	defer dnsMu.Unlock()
+
+	dnsRecords = nil
+}
+
+func dnsName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+func parseMX(value string) (*net.MX, error) {
+	fields := strings.Fields(value)
+	switch len(fields) {
+	case 1:
+		return &net.MX{Host: dnsName(fields[0]), Pref: 10}, nil
+	case 2:
+		pref, err := strconv.ParseUint(fields[0], 10, 16)
+		if err == nil {
+			return &net.MX{Host: dnsName(fields[1]), Pref: uint16(pref)}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid MX value %q, expected \"10 mx.example.com\"", value)
+}
+
+// parseZone reads the records of a zone file, one per line, as in
+//
+//	$ORIGIN example.com.
+//	@                IN TXT "v=spf1 ip4:192.0.2.0/24 -all"
+//	s1._domainkey    IN TXT "v=DKIM1; k=rsa; " "p=MIIBIjANBgkq..."
+//	mail        3600 IN A   192.0.2.10
+//
+// Names without a trailing dot are relative to $ORIGIN, and the strings of a
+// TXT record are joined. Records spanning several lines are rejected.
+func parseZone(zone string) ([]DNSRecord, error) {
+	var records []DNSRecord
+	origin := ""
+	last := ""
+	for i, line := range strings.Split(zone, "\n") {
+		line = stripZoneComment(line)
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if unquotedIndex(line, "()") >= 0 {
+			return nil, fmt.Errorf("line %d: records spanning several lines in parentheses are not supported", i+1)
+		}
+		fields := strings.Fields(line)
+		if strings.EqualFold(fields[0], "$ORIGIN") && len(fields) > 1 {
+			origin = dnsName(fields[1])
+			continue
+		} else if strings.HasPrefix(fields[0], "$") {
+			continue
+		}
+
+		// rest is what follows the fields consumed so far
+		rest := strings.TrimSpace(line)
+		next := func() string {
+			field, _, _ := strings.Cut(rest, " ")
+			field, _, _ = strings.Cut(field, "\t")
+			rest = strings.TrimSpace(rest[len(field):])
+			return field
+		}
+
+		// A line starting with whitespace continues the previous name
+		name := last
+		if line[0] != ' ' && line[0] != '\t' {
+			name = next()
+			switch {
+			case name == "@":
+				name = origin
+			case strings.HasSuffix(name, "."):
+				name = dnsName(name)
+			case origin != "":
+				name = dnsName(name) + "." + origin
+			}
+			last = name
+		}
+
+		// Skip the optional TTL and class before the type
+		recordType := next()
+		for isDigits(recordType) || strings.EqualFold(recordType, "IN") {
+			recordType = next()
+		}
+		if recordType == "" || rest == "" || name == "" {
+			return nil, fmt.Errorf("line %d: expected name, type and value", i+1)
+		}
+
+		record := DNSRecord{Name: name, Type: strings.ToUpper(recordType), Value: rest}
+		if record.Type == "TXT" {
+			record.Value = joinTXTStrings(rest)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func stripZoneComment(line string) string {
+	if i := unquotedIndex(line, ";"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// unquotedIndex returns the index of the first of chars in a zone file line
+// outside quoted strings, or -1.
+func unquotedIndex(line, chars string) int {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && strings.IndexByte(chars, c) >= 0:
+			return i
+		}
+	}
+	return -1
+}
+
+// joinTXTStrings joins the quoted strings of TXT record data, or returns the
+// data as it is when it is not quoted.
+func joinTXTStrings(rdata string) string {
+	if !strings.HasPrefix(rdata, "\"") {
+		return rdata
+	}
+
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(rdata); i++ {
+		switch c := rdata[i]; {
+		case c == '\\' && i+1 < len(rdata):
+			i++
+			b.WriteByte(rdata[i])
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// lookupDNS returns the values of the records with the given name and type.
+// Found is false when the override table has none, in which case the caller
+// falls back to the system resolver if DNS_FALLBACK=true.
+func lookupDNS(name, recordType string) (values []string, found bool) {
+	name = dnsName(name)
+
+	dnsMu.Lock()
+	defer dnsMu.Unlock()
+
+	for _, record := range dnsRecords {
+		if record.Type == recordType && record.Name == name {
+			values = append(values, record.Value)
+		}
+	}
+	return values, len(values) > 0
+}
+
+func dnsFallback() bool {
+	return getEnv("DNS_FALLBACK", "") == "true"
+}
+
+func dnsNotFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// lookupTXT answers from the override table. Names missing from it are not
+// found, unless DNS_FALLBACK=true sends them to the system resolver.
+func lookupTXT(name string) ([]string, error) {
+	if values, found := lookupDNS(name, "TXT"); found {
+		return values, nil
+	}
+	if dnsFallback() {
+		return net.LookupTXT(name)
+	}
+	return nil, dnsNotFound(name)
+}
+
+// dnsResolver resolves the queries of SPF checks like lookupTXT does.
+type dnsResolver struct{}
+
+func (dnsResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if values, found := lookupDNS(name, "TXT"); found {
+		return values, nil
+	}
+	if dnsFallback() {
+		return net.DefaultResolver.LookupTXT(ctx, name)
+	}
+	return nil, dnsNotFound(name)
+}
+
+func (dnsResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if values, found := lookupDNS(name, "MX"); found {
+		var mxs []*net.MX
+		for _, value := range values {
+			if mx, err := parseMX(value); err == nil {
+				mxs = append(mxs, mx)
+			}
+		}
+		return mxs, nil
+	}
+	if dnsFallback() {
+		return net.DefaultResolver.LookupMX(ctx, name)
+	}
+	return nil, dnsNotFound(name)
+}
+
+func (dnsResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	values, foundA := lookupDNS(host, "A")
+	more, foundAAAA := lookupDNS(host, "AAAA")
+	if foundA || foundAAAA {
+		var addrs []net.IPAddr
+		for _, value := range append(values, more...) {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(value)})
+		}
+		return addrs, nil
+	}
+	if dnsFallback() {
+		return net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+	return nil, dnsNotFound(host)
+}
+
+// LookupAddr serves the deprecated SPF ptr mechanism, which the override
+// table has no records for.
+func (dnsResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if dnsFallback() {
+		return net.DefaultResolver.LookupAddr(ctx, addr)
+	}
+	return nil, dnsNotFound(addr)
+}
+
+func handleGetDNSRecords(c *gin.Context) {
+	c.JSON(http.StatusOK, listDNSRecords())
+}
+
+func handleCreateDNSRecord(c *gin.Context) {
+	var record DNSRecord
+	if err := c.ShouldBindJSON(&record); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid DNS record"})
+		return
+	}
+
+	created, err := addDNSRecord(record)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, created)
+}
+
+func handleDeleteDNSRecord(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid DNS record ID"})
+		return
+	}
+
+	if !deleteDNSRecord(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "DNS record not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "DNS record deleted successfully"})
+}
+
+func handleClearDNSRecords(c *gin.Context) {
+	clearDNSRecords()
+	c.JSON(http.StatusOK, gin.H{"message": "DNS records cleared successfully"})
+}
@@ -0,0 +1,157 @@
+package mockmt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseZone(t *testing.T) {
+	tests := []struct {
+		name string
+		zone string
+		want []DNSRecord
+	}{
+		{
+			name: "relative names and @",
+			zone: `
+$ORIGIN Example.com.
+@      IN TXT "v=spf1 -all"
+mail   IN A   192.0.2.10
+`,
+			want: []DNSRecord{
+				{Name: "example.com", Type: "TXT", Value: "v=spf1 -all"},
+				{Name: "mail.example.com", Type: "A", Value: "192.0.2.10"},
+			},
+		},
+		{
+			name: "absolute names",
+			zone: `
+$ORIGIN example.com.
+Mail.Example.ORG.  IN MX 10 mx.example.org.
+`,
+			want: []DNSRecord{
+				{Name: "mail.example.org", Type: "MX", Value: "10 mx.example.org."},
+			},
+		},
+		{
+			name: "names without origin",
+			zone: `mail.example.com A 192.0.2.10`,
+			want: []DNSRecord{
+				{Name: "mail.example.com", Type: "A", Value: "192.0.2.10"},
+			},
+		},
+		{
+			name: "blank name continues the previous one",
+			zone: "$ORIGIN example.com.\n" +
+				"mail IN A 192.0.2.10\n" +
+				"     IN A 192.0.2.11\n" +
+				"\tIN TXT \"second\"\n",
+			want: []DNSRecord{
+				{Name: "mail.example.com", Type: "A", Value: "192.0.2.10"},
+				{Name: "mail.example.com", Type: "A", Value: "192.0.2.11"},
+				{Name: "mail.example.com", Type: "TXT", Value: "second"},
+			},
+		},
+		{
+			name: "TTL and class are skipped",
+			zone: `
+$ORIGIN example.com.
+$TTL 3600
+a  3600 IN  A    192.0.2.1
+b  IN   300 A    192.0.2.2
+c  60       txt  plain
+`,
+			want: []DNSRecord{
+				{Name: "a.example.com", Type: "A", Value: "192.0.2.1"},
+				{Name: "b.example.com", Type: "A", Value: "192.0.2.2"},
+				{Name: "c.example.com", Type: "TXT", Value: "plain"},
+			},
+		},
+		{
+			name: "comments outside quotes are stripped",
+			zone: `
+; a whole line comment
+$ORIGIN example.com. ; the origin
+_dmarc IN TXT "v=DMARC1; p=reject; rua=mailto:d@example.com" ; policy
+`,
+			want: []DNSRecord{
+				{Name: "_dmarc.example.com", Type: "TXT", Value: "v=DMARC1; p=reject; rua=mailto:d@example.com"},
+			},
+		},
+		{
+			name: "TXT strings are joined",
+			zone: `
+$ORIGIN example.com.
+s1._domainkey IN TXT "v=DKIM1; k=rsa; " "p=MIIB" "IjAN"
+quote         IN TXT "say \"hi\"; \\ done"
+`,
+			want: []DNSRecord{
+				{Name: "s1._domainkey.example.com", Type: "TXT", Value: "v=DKIM1; k=rsa; p=MIIBIjAN"},
+				{Name: "quote.example.com", Type: "TXT", Value: `say "hi"; \ done`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := parseZone(tt.zone)
+			if err != nil {
+				t.Fatalf("parseZone: %v", err)
+			}
+			if !reflect.DeepEqual(records, tt.want) {
+				t.Errorf("parseZone:\n got %+v\nwant %+v", records, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseZoneErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		zone string
+		want string
+	}{
+		{
+			name: "multi-line record",
+			zone: "$ORIGIN example.com.\n" +
+				"s1._domainkey IN TXT ( \"v=DKIM1; k=rsa; \"\n" +
+				"                       \"p=MIIB\" )\n",
+			want: "line 2: records spanning several lines",
+		},
+		{
+			name: "closing parenthesis alone",
+			zone: "example.com. IN TXT \"a\" )\n",
+			want: "line 1: records spanning several lines",
+		},
+		{
+			name: "missing value",
+			zone: "$ORIGIN example.com.\nmail IN A\n",
+			want: "line 2: expected name, type and value",
+		},
+		{
+			name: "continuation without a previous name",
+			zone: "  IN A 192.0.2.1\n",
+			want: "line 1: expected name, type and value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := parseZone(tt.zone)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("parseZone = %+v, %v; want error containing %q", records, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseZoneParenthesisInQuotes(t *testing.T) {
+	records, err := parseZone(`example.com. IN TXT "a (quoted) value"`)
+	if err != nil {
+		t.Fatalf("parseZone: %v", err)
+	}
+	if len(records) != 1 || records[0].Value != "a (quoted) value" {
+		t.Errorf("parseZone = %+v", records)
+	}
+}
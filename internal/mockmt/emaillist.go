@@ -0,0 +1,306 @@
+package mockmt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultEmailPageSize = 50
+	maxEmailPageSize     = 500
+	emailSnippetLength   = 100
+
+	// received_at is stored by SQLite's CURRENT_TIMESTAMP, in UTC
+	sqliteTimeFormat = "2006-01-02 15:04:05"
+)
+
+// emailSortColumns maps the sort parameter of the email list to the column
+// it orders by. Ties are broken by email ID.
+var emailSortColumns = map[string]string{
+	"received_at": "e.received_at",
+	"subject":     "e.subject COLLATE NOCASE",
+	"from":        "e.from_email COLLATE NOCASE",
+}
+
+// EmailSummary is the list projection of an email, without its bodies.
+// Snippet is the start of the text body.
+type EmailSummary struct {
+	ID             int       `json:"id"`
+	MessageID      string    `json:"message_id"`
+	FromEmail      string    `json:"from_email"`
+	ToEmail        string    `json:"to_email"`
+	Subject        string    `json:"subject"`
+	Snippet        string    `json:"snippet"`
+	ReceivedAt     time.Time `json:"received_at"`
+	IsBcc          bool      `json:"is_bcc"`
+	IsRead         bool      `json:"is_read"`
+	HasAttachments bool      `json:"has_attachments"`
+}
+
+// EmailPage is one page of the email list. NextCursor is empty on the last
+// page.
+type EmailPage struct {
+	Emails     []EmailSummary `json:"emails"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// EmailFilter selects and orders the emails of a user. From and To match
+// the envelope and header addresses and names, and Subject any part of the
+// subject. ToAddress is instead a whole recipient address, in any case.
+// Since is inclusive and Until exclusive. Terms are the words and
+// phrases of a search query, which must all appear in the email. AfterID
+// skips the emails stored up to the one with that ID.
+type EmailFilter struct {
+	Terms         []string
+	AfterID       int
+	From          string
+	To            string
+	ToAddress     string
+	Subject       string
+	Since         time.Time
+	Until         time.Time
+	HasAttachment *bool
+	Read          *bool
+	Sort          string
+	Desc          bool
+	Cursor        *emailCursor
+	Limit         int
+}
+
+// emailCursor is the position after the last email of a page: its sort key
+// and ID, along with the order it was listed in.
+type emailCursor struct {
+	Sort string `json:"s"`
+	Desc bool   `json:"d"`
+	Key  string `json:"k"`
+	ID   int    `json:"i"`
+}
+
+func (c *emailCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeEmailCursor(s string) (*emailCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c emailCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// parseEmailFilter reads the query parameters of GET /api/emails.
+func parseEmailFilter(c *gin.Context) (*EmailFilter, error) {
+	f := &EmailFilter{
+		From:    c.Query("from"),
+		To:      c.Query("to"),
+		Subject: c.Query("subject"),
+		Sort:    c.DefaultQuery("sort", "received_at"),
+		Limit:   defaultEmailPageSize,
+	}
+	if _, ok := emailSortColumns[f.Sort]; !ok {
+		return nil, fmt.Errorf("invalid sort %q, expected received_at, subject or from", f.Sort)
+	}
+
+	switch order := c.Query("order"); order {
+	case "":
+		f.Desc = f.Sort == "received_at"
+	case "asc", "desc":
+		f.Desc = order == "desc"
+	default:
+		return nil, fmt.Errorf("invalid order %q, expected asc or desc", order)
+	}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit %q", value)
+		}
+		f.Limit = min(limit, maxEmailPageSize)
+	}
+
+	var err error
+	if f.Since, err = parseEmailTime(c.Query("since"), false); err != nil {
+		return nil, fmt.Errorf("invalid since: %v", err)
+	}
+	if f.Until, err = parseEmailTime(c.Query("until"), true); err != nil {
+		return nil, fmt.Errorf("invalid until: %v", err)
+	}
+	if f.HasAttachment, err = parseOptionalBool(c.Query("has_attachment")); err != nil {
+		return nil, fmt.Errorf("invalid has_attachment: %v", err)
+	}
+	if f.Read, err = parseOptionalBool(c.Query("read")); err != nil {
+		return nil, fmt.Errorf("invalid read: %v", err)
+	}
+
+	if value := c.Query("cursor"); value != "" {
+		f.Cursor, err = decodeEmailCursor(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		if f.Cursor.Sort != f.Sort || f.Cursor.Desc != f.Desc {
+			return nil, fmt.Errorf("cursor does not match the sort order")
+		}
+	}
+
+	return f, nil
+}
+
+// parseEmailTime accepts RFC 3339 timestamps and dates. A date used as the
+// end of a range includes that whole day.
+func parseEmailTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a date or RFC 3339 timestamp, got %q", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func parseOptionalBool(value string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("expected true or false, got %q", value)
+	}
+	return &b, nil
+}
+
+// likeContains returns a LIKE pattern, to be used with ESCAPE '\', matching
+// values that contain s.
+func likeContains(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+	return "%" + s + "%"
+}
+
+// listEmails returns one page of the non-deleted emails of a user, with the
+// filters, sort order and cursor applied in SQL.
+func listEmails(userID int, f *EmailFilter) (*EmailPage, error) {
+	sortColumn := emailSortColumns[f.Sort]
+	query := `
+		SELECT e.id, e.message_id, e.from_email, r.to_email, e.subject, substr(COALESCE(e.body, ''), 1, ?), e.received_at, r.is_bcc, COALESCE(r.is_read, FALSE),
+			EXISTS (SELECT 1 FROM attachments a WHERE a.email_id = e.id), CAST(` + sortColumn + ` AS TEXT)
+		FROM email_recipients r
+		JOIN emails e ON e.id = r.email_id
+		WHERE r.user_id = ? AND r.is_deleted = FALSE`
+	args := []any{emailSnippetLength, userID}
+
+	if f.From != "" {
+		query += ` AND (e.from_email LIKE ? ESCAPE '\' OR EXISTS (
+			SELECT 1 FROM email_addresses a
+			WHERE a.email_id = e.id AND a.field = 'from' AND (a.address LIKE ? ESCAPE '\' OR a.name LIKE ? ESCAPE '\')))`
+		pattern := likeContains(f.From)
+		args = append(args, pattern, pattern, pattern)
+	}
+	if f.To != "" {
+		query += ` AND (r.to_email LIKE ? ESCAPE '\' OR EXISTS (
+			SELECT 1 FROM email_addresses a
+			WHERE a.email_id = e.id AND a.field IN ('to', 'cc', 'rcpt-to') AND (a.address LIKE ? ESCAPE '\' OR a.name LIKE ? ESCAPE '\')))`
+		pattern := likeContains(f.To)
+		args = append(args, pattern, pattern, pattern)
+	}
+	if f.ToAddress != "" {
+		query += ` AND (r.to_email = ? COLLATE NOCASE OR EXISTS (
+			SELECT 1 FROM email_addresses a
+			WHERE a.email_id = e.id AND a.field IN ('to', 'cc', 'rcpt-to') AND a.address = ? COLLATE NOCASE))`
+		args = append(args, f.ToAddress, f.ToAddress)
+	}
+	if f.AfterID > 0 {
+		query += ` AND e.id > ?`
+		args = append(args, f.AfterID)
+	}
+	if f.Subject != "" {
+		query += ` AND e.subject LIKE ? ESCAPE '\'`
+		args = append(args, likeContains(f.Subject))
+	}
+	if !f.Since.IsZero() {
+		query += ` AND e.received_at >= ?`
+		args = append(args, f.Since.UTC().Format(sqliteTimeFormat))
+	}
+	if !f.Until.IsZero() {
+		query += ` AND e.received_at < ?`
+		args = append(args, f.Until.UTC().Format(sqliteTimeFormat))
+	}
+	if f.HasAttachment != nil {
+		condition := `EXISTS (SELECT 1 FROM attachments a WHERE a.email_id = e.id)`
+		if !*f.HasAttachment {
+			condition = `NOT ` + condition
+		}
+		query += ` AND ` + condition
+	}
+	if f.Read != nil {
+		query += ` AND COALESCE(r.is_read, FALSE) = ?`
+		args = append(args, *f.Read)
+	}
+	if len(f.Terms) > 0 {
+		condition, termArgs := searchTermsCondition(f.Terms)
+		query += condition
+		args = append(args, termArgs...)
+	}
+
+	order, compare := "ASC", ">"
+	if f.Desc {
+		order, compare = "DESC", "<"
+	}
+	if f.Cursor != nil {
+		query += fmt.Sprintf(` AND (%[1]s %[2]s ? OR (%[1]s = ? AND e.id %[2]s ?))`, sortColumn, compare)
+		args = append(args, f.Cursor.Key, f.Cursor.Key, f.Cursor.ID)
+	}
+	query += fmt.Sprintf(` ORDER BY %s %s, e.id %s LIMIT ?`, sortColumn, order, order)
+	// One more row than the page tells whether there is a next page
+	args = append(args, f.Limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &EmailPage{Emails: []EmailSummary{}}
+	var keys []string
+	for rows.Next() {
+		var email EmailSummary
+		var key string
+		err := rows.Scan(
+			&email.ID, &email.MessageID, &email.FromEmail, &email.ToEmail, &email.Subject, &email.Snippet,
+			&email.ReceivedAt, &email.IsBcc, &email.IsRead, &email.HasAttachments, &key,
+		)
+		if err != nil {
+			return nil, err
+		}
+		page.Emails = append(page.Emails, email)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Emails) > f.Limit {
+		page.Emails = page.Emails[:f.Limit]
+		last := page.Emails[f.Limit-1]
+		cursor := &emailCursor{Sort: f.Sort, Desc: f.Desc, Key: keys[f.Limit-1], ID: last.ID}
+		page.NextCursor = cursor.encode()
+	}
+
+	return page, nil
+}
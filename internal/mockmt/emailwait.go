@@ -0,0 +1,105 @@
+package mockmt
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultEmailWait = 30 * time.Second
+	maxEmailWait     = 5 * time.Minute
+)
+
+var (
+	emailStoredMu sync.Mutex
+	emailStored   = make(chan struct{})
+)
+
+// notifyEmailStored wakes every request waiting for an email, by closing the
+// channel they wait on and starting a new one.
+func notifyEmailStored() {
+	emailStoredMu.Lock()
+	defer emailStoredMu.Unlock()
+
+	close(emailStored)
+	emailStored = make(chan struct{})
+}
+
+func emailStoredSignal() <-chan struct{} {
+	emailStoredMu.Lock()
+	defer emailStoredMu.Unlock()
+
+	return emailStored
+}
+
+func getLastEmailID() (int, error) {
+	var id int
+	err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM emails`).Scan(&id)
+	return id, err
+}
+
+// handleWaitForEmail blocks until an email matching the filters of the email
+// list has been stored, and returns the newest one. Without since, only
+// emails stored after the request started are returned. Unlike the list, to
+// is a whole recipient address, and to_contains matches part of one.
+func handleWaitForEmail(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	filter, err := parseEmailFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.ToAddress, filter.To = filter.To, c.Query("to_contains")
+	if c.Query("since") == "" {
+		if filter.AfterID, err = getLastEmailID(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get emails"})
+			return
+		}
+	}
+	filter.Sort, filter.Desc, filter.Cursor, filter.Limit = "received_at", true, nil, 1
+
+	timeout := defaultEmailWait
+	if value := c.Query("timeout"); value != "" {
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timeout, expected a duration such as 30s"})
+			return
+		}
+		timeout = min(timeout, maxEmailWait)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		// Take the signal before querying, so that an email stored in
+		// between still wakes us
+		stored := emailStoredSignal()
+
+		page, err := listEmails(userID, filter)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get emails"})
+			return
+		}
+		if len(page.Emails) > 0 {
+			email, err := getEmailByID(page.Emails[0].ID, userID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get email"})
+				return
+			}
+			c.JSON(http.StatusOK, email)
+			return
+		}
+
+		select {
+		case <-stored:
+		case <-timer.C:
+			c.JSON(http.StatusRequestTimeout, gin.H{"error": "No matching email before timeout"})
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
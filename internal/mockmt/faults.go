@@ -0,0 +1,246 @@
+package mockmt
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	stageMail = "mail"
+	stageRcpt = "rcpt"
+	stageData = "data"
+)
+
+// FaultRule makes the SMTP server answer with a chosen reply instead of
+// accepting the command, so mailers can be tested against failing servers.
+type FaultRule struct {
+	ID           int     `json:"id"`
+	Stage        string  `json:"stage"`
+	Sender       string  `json:"sender"`
+	Recipient    string  `json:"recipient"`
+	Probability  float64 `json:"probability"`
+	EveryNth     int     `json:"every_nth"`
+	Code         int     `json:"code"`
+	EnhancedCode string  `json:"enhanced_code"`
+	Message      string  `json:"message"`
+	Matched      int     `json:"matched"`
+}
+
+var faultReplies = map[int]struct {
+	enhancedCode string
+	message      string
+}{
+	421: {"4.3.0", "Service not available, closing transmission channel"},
+	450: {"4.2.1", "Mailbox unavailable, try again later"},
+	451: {"4.3.0", "Local error in processing, try again later"},
+	452: {"4.2.2", "Insufficient system storage"},
+	550: {"5.1.1", "Mailbox unavailable"},
+	552: {"5.3.4", "Message size exceeds fixed maximum"},
+	554: {"5.7.1", "Transaction failed"},
+}
+
+var (
+	faultMu     sync.Mutex
+	faultRules  []*FaultRule
+	faultNextID = 1
+)
+
+// loadFaultRules reads the initial rule set from FAULT_RULES_FILE (a JSON
+// array) and FAULT_RULES (the same JSON inline).
+func loadFaultRules() error {
+	rules, err := loadRulesFromEnv[FaultRule]("FAULT_RULES_FILE", "FAULT_RULES")
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if _, err := addFaultRule(rule); err != nil {
+			return err
+		}
+	}
+	if len(rules) > 0 {
+		log.Printf("Loaded %d SMTP fault rules", len(rules))
+	}
+	return nil
+}
+
+func addFaultRule(rule FaultRule) (*FaultRule, error) {
+	rule.Stage = strings.ToLower(rule.Stage)
+	if rule.Stage != stageMail && rule.Stage != stageRcpt && rule.Stage != stageData {
+		return nil, fmt.Errorf("invalid stage %q, expected mail, rcpt or data", rule.Stage)
+	}
+	reply, ok := faultReplies[rule.Code]
+	if !ok {
+		return nil, fmt.Errorf("unsupported reply code %d", rule.Code)
+	}
+	// A probability of 0, the default, fires the rule every time
+	if rule.Probability < 0 || rule.Probability > 1 {
+		return nil, fmt.Errorf("invalid probability %v, expected a value between 0 and 1", rule.Probability)
+	}
+	if rule.EveryNth < 0 {
+		return nil, fmt.Errorf("invalid every_nth %d, expected a positive number", rule.EveryNth)
+	}
+	if rule.Stage == stageMail && rule.Recipient != "" {
+		return nil, fmt.Errorf("recipient pattern cannot be used at the mail stage")
+	}
+	if rule.EnhancedCode == "" {
+		rule.EnhancedCode = reply.enhancedCode
+	}
+	if _, err := parseEnhancedCode(rule.EnhancedCode); err != nil {
+		return nil, err
+	}
+	if rule.Message == "" {
+		rule.Message = reply.message
+	}
+
+	faultMu.Lock()
+	defer faultMu.Unlock()
+
+	rule.ID = faultNextID
+	rule.Matched = 0
+	faultNextID++
+	faultRules = append(faultRules, &rule)
+	// Return a copy, as checkFaults updates the stored rule under faultMu
+	// while the caller serializes it
+	created := rule
+	return &created, nil
+}
+
+func listFaultRules() []FaultRule {
+	faultMu.Lock()
+	defer faultMu.Unlock()
+
+	rules := []FaultRule{}
+	for _, rule := range faultRules {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+func deleteFaultRule(id int) bool {
+	faultMu.Lock()
+	defer faultMu.Unlock()
+
+	for i, rule := range faultRules {
+		if rule.ID == id {
+			faultRules = append(faultRules[:i], faultRules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func clearFaultRules() {
+	faultMu.Lock()
+	defer faultMu.Unlock()
+
+	faultRules = nil
+}
+
+// checkFaults returns the SMTP error of the first rule for the given stage
+// that fires, or nil when the command should proceed normally.
+func checkFaults(stage, from string, to []string) error {
+	faultMu.Lock()
+	defer faultMu.Unlock()
+
+	for _, rule := range faultRules {
+		if rule.Stage != stage || !matchPattern(rule.Sender, from) {
+			continue
+		}
+		if rule.Recipient != "" && !matchAnyPattern(rule.Recipient, to) {
+			continue
+		}
+
+		rule.Matched++
+		if rule.EveryNth > 1 && rule.Matched%rule.EveryNth != 0 {
+			continue
+		}
+		if rule.Probability > 0 && rule.Probability < 1 && rand.Float64() >= rule.Probability {
+			continue
+		}
+
+		enhancedCode, _ := parseEnhancedCode(rule.EnhancedCode)
+		log.Printf("Fault rule %d fired at %s stage: %d %s", rule.ID, stage, rule.Code, rule.Message)
+		return &smtp.SMTPError{
+			Code:         rule.Code,
+			EnhancedCode: enhancedCode,
+			Message:      rule.Message,
+		}
+	}
+
+	return nil
+}
+
+func matchAnyPattern(pattern string, values []string) bool {
+	for _, v := range values {
+		if matchPattern(pattern, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseEnhancedCode(s string) (smtp.EnhancedCode, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return smtp.EnhancedCode{}, fmt.Errorf("invalid enhanced code %q", s)
+	}
+
+	var code smtp.EnhancedCode
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return smtp.EnhancedCode{}, fmt.Errorf("invalid enhanced code %q", s)
+		}
+		code[i] = n
+	}
+	return code, nil
+}
+
+func handleGetFaultRules(c *gin.Context) {
+	c.JSON(http.StatusOK, listFaultRules())
+}
+
+func handleCreateFaultRule(c *gin.Context) {
+	var rule FaultRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid fault rule"})
+		return
+	}
+
+	created, err := addFaultRule(rule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, created)
+}
+
+func handleDeleteFaultRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid fault rule ID"})
+		return
+	}
+
+	if !deleteFaultRule(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Fault rule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Fault rule deleted successfully"})
+}
+
+func handleClearFaultRules(c *gin.Context) {
+	clearFaultRules()
+	c.JSON(http.StatusOK, gin.H{"message": "Fault rules cleared successfully"})
+}
@@ -0,0 +1,87 @@
+package mockmt
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/gin-gonic/gin"
+)
+
+var errGreylisted = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Greylisted, please try again later",
+}
+
+// checkGreylist temporarily rejects the first attempt of a new triplet and
+// accepts retries made once the delay has passed.
+func checkGreylist(clientIP, from, to string, delay time.Duration) error {
+	from = strings.ToLower(from)
+	to = strings.ToLower(to)
+	now := time.Now().UTC()
+
+	var id int
+	var firstSeen time.Time
+	var passedAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT id, first_seen, passed_at
+		FROM greylist
+		WHERE client_ip = ? AND mail_from = ? AND rcpt_to = ?
+	`, clientIP, from, to).Scan(&id, &firstSeen, &passedAt)
+
+	if err == sql.ErrNoRows {
+		_, err = db.Exec(`
+			INSERT INTO greylist (client_ip, mail_from, rcpt_to, first_seen)
+			VALUES (?, ?, ?, ?)
+		`, clientIP, from, to, now)
+		if err != nil {
+			return err
+		}
+		log.Printf("Greylisted new triplet: ip=%s, from=%s, to=%s", clientIP, from, to)
+		return errGreylisted
+	} else if err != nil {
+		return err
+	}
+
+	if passedAt.Valid {
+		return nil
+	}
+
+	if now.Sub(firstSeen) < delay {
+		_, err = db.Exec("UPDATE greylist SET attempts = attempts + 1 WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		return errGreylisted
+	}
+
+	_, err = db.Exec("UPDATE greylist SET attempts = attempts + 1, passed_at = ? WHERE id = ?", now, id)
+	return err
+}
+
+func clearGreylist() error {
+	_, err := db.Exec("DELETE FROM greylist")
+	return err
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func handleClearGreylist(c *gin.Context) {
+	if err := clearGreylist(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear greylist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Greylist cleared successfully"})
+}
@@ -0,0 +1,202 @@
+package mockmt
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlToText renders an HTML body as plain text for messages without a
+// text/plain part. Style and script content is dropped, paragraphs and
+// lists keep their structure and links are written as "text [url]".
+func htmlToText(s string) string {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return ""
+	}
+
+	r := &textRenderer{}
+	r.render(doc)
+
+	lines := strings.Split(r.b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+type textRenderer struct {
+	b        strings.Builder
+	newlines int   // newlines at the end of the output so far
+	space    bool  // whitespace seen since the last word
+	pre      int   // depth of enclosing <pre> elements
+	lists    []int // next item number of each enclosing list, 0 for <ul>
+}
+
+func (r *textRenderer) render(n *html.Node) {
+	if n.Type == html.TextNode {
+		r.text(n.Data)
+		return
+	}
+	if n.Type != html.ElementNode {
+		r.children(n)
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Style, atom.Script, atom.Noscript, atom.Template:
+		return
+	case atom.Br:
+		r.lineBreak(1)
+	case atom.Hr:
+		r.lineBreak(2)
+		r.write("---")
+		r.lineBreak(2)
+	case atom.Img:
+		if alt := attr(n, "alt"); alt != "" {
+			r.text(alt)
+		}
+	case atom.A:
+		start := r.b.Len()
+		r.children(n)
+		r.link(attr(n, "href"), strings.TrimSpace(r.b.String()[start:]))
+	case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Blockquote, atom.Table:
+		r.lineBreak(2)
+		r.children(n)
+		r.lineBreak(2)
+	case atom.Pre:
+		r.lineBreak(2)
+		r.pre++
+		r.children(n)
+		r.pre--
+		r.lineBreak(2)
+	case atom.Ul, atom.Ol:
+		next := 0
+		if n.DataAtom == atom.Ol {
+			next = 1
+			if start, err := strconv.Atoi(attr(n, "start")); err == nil && start > 0 {
+				next = start
+			}
+		}
+		// Nested lists continue their parent item without a blank line
+		gap := 2
+		if len(r.lists) > 0 {
+			gap = 1
+		}
+		r.lineBreak(gap)
+		r.lists = append(r.lists, next)
+		r.children(n)
+		r.lists = r.lists[:len(r.lists)-1]
+		r.lineBreak(gap)
+	case atom.Li:
+		r.lineBreak(1)
+		r.listMarker()
+		r.children(n)
+		r.lineBreak(1)
+	case atom.Td, atom.Th:
+		r.space = true
+		r.children(n)
+		r.space = true
+	case atom.Div, atom.Tr, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Dt, atom.Dd:
+		r.lineBreak(1)
+		r.children(n)
+		r.lineBreak(1)
+	default:
+		r.children(n)
+	}
+}
+
+func (r *textRenderer) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.render(c)
+	}
+}
+
+// text writes a text node, collapsing whitespace outside <pre>.
+func (r *textRenderer) text(s string) {
+	if r.pre > 0 {
+		r.write(s)
+		return
+	}
+
+	if strings.TrimLeftFunc(s, unicode.IsSpace) != s {
+		r.space = true
+	}
+	for i, word := range strings.Fields(s) {
+		if i > 0 {
+			r.space = true
+		}
+		r.write(word)
+	}
+	if strings.TrimRightFunc(s, unicode.IsSpace) != s {
+		r.space = true
+	}
+}
+
+func (r *textRenderer) write(s string) {
+	if s == "" {
+		return
+	}
+	if r.space && r.newlines == 0 && r.b.Len() > 0 {
+		r.b.WriteByte(' ')
+	}
+	r.space = false
+	r.b.WriteString(s)
+	if trailing := len(s) - len(strings.TrimRight(s, "\n")); trailing == len(s) {
+		r.newlines += trailing
+	} else {
+		r.newlines = trailing
+	}
+}
+
+// lineBreak makes sure the output ends with at least n newlines.
+func (r *textRenderer) lineBreak(n int) {
+	if r.b.Len() == 0 {
+		return
+	}
+	for r.newlines < n {
+		r.b.WriteByte('\n')
+		r.newlines++
+	}
+	r.space = false
+}
+
+func (r *textRenderer) listMarker() {
+	if len(r.lists) == 0 {
+		return
+	}
+	depth := len(r.lists) - 1
+	marker := "-"
+	if next := r.lists[depth]; next > 0 {
+		marker = strconv.Itoa(next) + "."
+		r.lists[depth]++
+	}
+	r.write(strings.Repeat("  ", depth) + marker)
+	r.space = true
+}
+
+// link appends the URL after the link text unless it adds nothing, as for
+// in-page anchors or a mailto: link showing its own address.
+func (r *textRenderer) link(href, text string) {
+	href = strings.TrimSpace(href)
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+		return
+	}
+	if text == href || text == strings.TrimPrefix(href, "mailto:") {
+		return
+	}
+	r.space = text != ""
+	r.write("[" + href + "]")
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,238 @@
+package mockmt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errConnectionDropped = errors.New("connection dropped by latency rule")
+
+// LatencyRule slows down or breaks SMTP sessions for recipients in the
+// matching domain, to reproduce slow and flaky servers.
+type LatencyRule struct {
+	ID              int    `json:"id"`
+	Domain          string `json:"domain"`
+	GreetingDelayMs int    `json:"greeting_delay_ms"`
+	RcptDelayMs     int    `json:"rcpt_delay_ms"`
+	DataDelayMs     int    `json:"data_delay_ms"`
+	DropDuringData  bool   `json:"drop_during_data"`
+	DropAfterBytes  int    `json:"drop_after_bytes"`
+	HangAfterData   bool   `json:"hang_after_data"`
+}
+
+var (
+	latencyMu     sync.Mutex
+	latencyRules  []*LatencyRule
+	latencyNextID = 1
+)
+
+// loadLatencyRules reads the initial rule set from LATENCY_RULES_FILE (a JSON
+// array) and LATENCY_RULES (the same JSON inline).
+func loadLatencyRules() error {
+	rules, err := loadRulesFromEnv[LatencyRule]("LATENCY_RULES_FILE", "LATENCY_RULES")
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if _, err := addLatencyRule(rule); err != nil {
+			return err
+		}
+	}
+	if len(rules) > 0 {
+		log.Printf("Loaded %d SMTP latency rules", len(rules))
+	}
+	return nil
+}
+
+func addLatencyRule(rule LatencyRule) (*LatencyRule, error) {
+	// The greeting is sent before any recipient is known
+	if rule.Domain != "" && rule.GreetingDelayMs > 0 {
+		return nil, fmt.Errorf("greeting delay cannot be scoped to a domain")
+	}
+	if rule.GreetingDelayMs < 0 || rule.RcptDelayMs < 0 || rule.DataDelayMs < 0 || rule.DropAfterBytes < 0 {
+		return nil, fmt.Errorf("delays and byte counts must not be negative")
+	}
+
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	rule.ID = latencyNextID
+	latencyNextID++
+	latencyRules = append(latencyRules, &rule)
+	created := rule
+	return &created, nil
+}
+
+func listLatencyRules() []LatencyRule {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	rules := []LatencyRule{}
+	for _, rule := range latencyRules {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+func deleteLatencyRule(id int) bool {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	for i, rule := range latencyRules {
+		if rule.ID == id {
+			latencyRules = append(latencyRules[:i], latencyRules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func clearLatencyRules() {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	latencyRules = nil
+}
+
+// affectsMessage reports whether the rule does anything after the greeting.
+func (r *LatencyRule) affectsMessage() bool {
+	return r.RcptDelayMs > 0 || r.DataDelayMs > 0 || r.DropDuringData || r.HangAfterData
+}
+
+// latencyRuleFor returns a copy of the first rule affecting messages whose
+// domain matches one of the recipients, or nil.
+func latencyRuleFor(recipients []string) *LatencyRule {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	for _, rule := range latencyRules {
+		if !rule.affectsMessage() {
+			continue
+		}
+		for _, rcpt := range recipients {
+			if matchPattern(rule.Domain, addressDomain(rcpt)) {
+				found := *rule
+				return &found
+			}
+		}
+	}
+	return nil
+}
+
+func greetingDelay() time.Duration {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	var delay time.Duration
+	for _, rule := range latencyRules {
+		if d := time.Duration(rule.GreetingDelayMs) * time.Millisecond; d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+func addressDomain(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+	return ""
+}
+
+// latencyListener delays the greeting of accepted connections.
+type latencyListener struct {
+	net.Listener
+}
+
+func (l *latencyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if delay := greetingDelay(); delay > 0 {
+		return &delayedConn{Conn: c, delay: delay}, nil
+	}
+	return c, nil
+}
+
+// delayedConn holds back its first write, which is the server greeting.
+type delayedConn struct {
+	net.Conn
+	delay time.Duration
+	once  sync.Once
+}
+
+func (c *delayedConn) Write(b []byte) (int, error) {
+	c.once.Do(func() { time.Sleep(c.delay) })
+	return c.Conn.Write(b)
+}
+
+// dropDuringData reads part of the message and then closes the connection
+// without replying.
+func dropDuringData(conn net.Conn, r io.Reader, afterBytes int) error {
+	if _, err := io.CopyN(io.Discard, r, int64(afterBytes)); err != nil && err != io.EOF {
+		return err
+	}
+	log.Printf("Dropping connection from %s during DATA after %d bytes", conn.RemoteAddr(), afterBytes)
+	conn.Close()
+	return errConnectionDropped
+}
+
+// hangUntilClosed never answers the client; it returns once the client gives
+// up and closes the connection.
+func hangUntilClosed(conn net.Conn) {
+	log.Printf("Hanging connection from %s after DATA", conn.RemoteAddr())
+	io.Copy(io.Discard, conn)
+	conn.Close()
+}
+
+func handleGetLatencyRules(c *gin.Context) {
+	c.JSON(http.StatusOK, listLatencyRules())
+}
+
+func handleCreateLatencyRule(c *gin.Context) {
+	var rule LatencyRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid latency rule"})
+		return
+	}
+
+	created, err := addLatencyRule(rule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, created)
+}
+
+func handleDeleteLatencyRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid latency rule ID"})
+		return
+	}
+
+	if !deleteLatencyRule(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Latency rule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Latency rule deleted successfully"})
+}
+
+func handleClearLatencyRules(c *gin.Context) {
+	clearLatencyRules()
+	c.JSON(http.StatusOK, gin.H{"message": "Latency rules cleared successfully"})
+}
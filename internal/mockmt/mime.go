@@ -0,0 +1,185 @@
+package mockmt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+// MIMEPart is one node of a message's MIME structure. The message itself is
+// part "1", its children "1.1", "1.2" and so on. Size is the decoded size of
+// a leaf part, or the total of the children for multipart and message parts.
+type MIMEPart struct {
+	Path         string     `json:"path"`
+	ContentType  string     `json:"content_type"`
+	Charset      string     `json:"charset,omitempty"`
+	Encoding     string     `json:"encoding"`
+	Disposition  string     `json:"disposition,omitempty"`
+	Filename     string     `json:"filename,omitempty"`
+	ContentID    string     `json:"content_id,omitempty"`
+	Subject      string     `json:"subject,omitempty"`
+	Size         int        `json:"size"`
+	AttachmentID int        `json:"attachment_id,omitempty"`
+	Parts        []MIMEPart `json:"parts,omitempty"`
+
+	attachment int // index into Email.Attachments plus one, 0 when none
+}
+
+// mimeParser walks a message's MIME tree. Inline text parts make up the
+// body, in order, and every other leaf becomes an attachment. Forwarded
+// message/rfc822 parts are kept as one attachment and their own parts are
+// only recorded in the tree.
+type mimeParser struct {
+	body        []string
+	htmlBody    []string
+	charset     string
+	htmlCharset string
+	attachments []Attachment
+}
+
+func (p *mimeParser) walk(e *message.Entity, path string, forwarded bool) MIMEPart {
+	contentType, params, _ := e.Header.ContentType()
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	disposition, _, _ := e.Header.ContentDisposition()
+	filename, _ := (&mail.AttachmentHeader{Header: e.Header}).Filename()
+	encoding := strings.ToLower(e.Header.Get("Content-Transfer-Encoding"))
+	if encoding == "" {
+		encoding = "7bit"
+	}
+
+	part := MIMEPart{
+		Path:        path,
+		ContentType: contentType,
+		Charset:     strings.ToLower(params["charset"]),
+		Encoding:    encoding,
+		Disposition: disposition,
+		Filename:    filename,
+		ContentID:   strings.Trim(e.Header.Get("Content-Id"), "<> "),
+	}
+
+	if mr := e.MultipartReader(); mr != nil {
+		for i := 1; ; i++ {
+			child, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if message.IsUnknownCharset(err) {
+				log.Printf("Unknown charset, keeping part undecoded: %v", err)
+			} else if err != nil {
+				log.Printf("Error reading part: %v", err)
+				break
+			}
+
+			c := p.walk(child, fmt.Sprintf("%s.%d", path, i), forwarded)
+			part.Size += c.Size
+			part.Parts = append(part.Parts, c)
+		}
+		return part
+	}
+
+	data, err := io.ReadAll(e.Body)
+	if err != nil {
+		log.Printf("Error reading part %s: %v", path, err)
+	}
+	part.Size = len(data)
+
+	isText := contentType == "text/plain" || contentType == "text/html"
+	switch {
+	case contentType == "message/rfc822" || contentType == "message/global":
+		inner, err := message.Read(bytes.NewReader(data))
+		if err != nil && !message.IsUnknownCharset(err) {
+			log.Printf("Error parsing forwarded message in part %s: %v", path, err)
+		} else {
+			innerHeader := mail.Header{Header: inner.Header}
+			part.Subject, _ = innerHeader.Subject()
+			part.Parts = []MIMEPart{p.walk(inner, path+".1", true)}
+		}
+		if !forwarded {
+			if filename == "" && part.Subject != "" {
+				filename = part.Subject + ".eml"
+			}
+			p.attachments = append(p.attachments, newAttachment(&e.Header, data, filename))
+			part.attachment = len(p.attachments)
+		}
+	case forwarded:
+		// Parts of a forwarded message stay inside its attachment
+	case isText && disposition != "attachment":
+		if contentType == "text/plain" {
+			p.body = append(p.body, string(data))
+			if p.charset == "" {
+				p.charset = part.Charset
+			}
+		} else {
+			p.htmlBody = append(p.htmlBody, string(data))
+			if p.htmlCharset == "" {
+				p.htmlCharset = part.Charset
+			}
+		}
+	default:
+		p.attachments = append(p.attachments, newAttachment(&e.Header, data, filename))
+		part.attachment = len(p.attachments)
+	}
+
+	return part
+}
+
+func newAttachment(h *message.Header, data []byte, filename string) Attachment {
+	contentType, _, _ := h.ContentType()
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	disposition, _, _ := h.ContentDisposition()
+	if disposition == "" {
+		disposition = "inline"
+	}
+	if filename == "" {
+		filename = "attachment"
+	}
+
+	return Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        len(data),
+		ContentID:   strings.Trim(h.Get("Content-Id"), "<> "),
+		Disposition: disposition,
+		Data:        data,
+	}
+}
+
+// flattenParts lists the tree in pre-order, which is the order it is stored in.
+func flattenParts(part MIMEPart) []MIMEPart {
+	parts := []MIMEPart{part}
+	for _, child := range part.Parts {
+		parts = append(parts, flattenParts(child)...)
+	}
+	return parts
+}
+
+// buildPartTree rebuilds the tree from parts listed in pre-order.
+func buildPartTree(parts []MIMEPart) *MIMEPart {
+	if len(parts) == 0 {
+		return nil
+	}
+
+	var build func(i int) (MIMEPart, int)
+	build = func(i int) (MIMEPart, int) {
+		part := parts[i]
+		part.Parts = nil
+		i++
+		for i < len(parts) && strings.HasPrefix(parts[i].Path, part.Path+".") {
+			var child MIMEPart
+			child, i = build(i)
+			part.Parts = append(part.Parts, child)
+		}
+		return part, i
+	}
+
+	root, _ := build(0)
+	return &root
+}
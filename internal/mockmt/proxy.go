@@ -0,0 +1,70 @@
+package mockmt
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// loadProxyPolicy returns the PROXY protocol policy for the SMTP listeners,
+// or nil when PROXY_PROTOCOL is not enabled. Connections from the load
+// balancers in PROXY_PROTOCOL_TRUSTED (all connections when empty) must start
+// with a v1 or v2 header, whose source address then becomes the client
+// address. Other connections are served as they are.
+func loadProxyPolicy() (proxyproto.ConnPolicyFunc, error) {
+	if getEnv("PROXY_PROTOCOL", "") != "true" {
+		return nil, nil
+	}
+
+	var trusted []*net.IPNet
+	for _, entry := range strings.Split(getEnv("PROXY_PROTOCOL_TRUSTED", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY_PROTOCOL_TRUSTED entry %q: %v", entry, err)
+		}
+		trusted = append(trusted, network)
+	}
+
+	if len(trusted) == 0 {
+		log.Printf("PROXY protocol required on all SMTP connections")
+	} else {
+		log.Printf("PROXY protocol required on SMTP connections from %d trusted networks", len(trusted))
+	}
+
+	return func(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+		if len(trusted) == 0 {
+			return proxyproto.REQUIRE, nil
+		}
+		ip := net.ParseIP(remoteIP(opts.Upstream))
+		for _, network := range trusted {
+			if ip != nil && network.Contains(ip) {
+				return proxyproto.REQUIRE, nil
+			}
+		}
+		return proxyproto.SKIP, nil
+	}, nil
+}
+
+// listenSMTP opens the listener for one of the SMTP ports, reading PROXY
+// protocol headers when policy is set.
+func listenSMTP(addr string, policy proxyproto.ConnPolicyFunc) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil || policy == nil {
+		return l, err
+	}
+	return &proxyproto.Listener{Listener: l, ConnPolicy: policy}, nil
+}
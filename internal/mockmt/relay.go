@@ -0,0 +1,403 @@
+package mockmt
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	relayTLSNone     = "none"
+	relayTLSStartTLS = "starttls"
+	relayTLSImplicit = "tls"
+
+	deliverySent   = "sent"
+	deliveryFailed = "failed"
+)
+
+var errRelayNotConfigured = errors.New("relay is not configured, set RELAY_HOST")
+
+// RelayRule releases incoming messages to the upstream server automatically
+// when the sender and any recipient match its glob patterns. To replaces the
+// envelope recipients when set.
+type RelayRule struct {
+	ID        int      `json:"id"`
+	Sender    string   `json:"sender"`
+	Recipient string   `json:"recipient"`
+	To        []string `json:"to"`
+}
+
+// Delivery records one attempt to relay a stored message upstream.
+type Delivery struct {
+	ID        int       `json:"id"`
+	EmailID   int       `json:"email_id"`
+	RcptTo    []string  `json:"rcpt_to"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Automatic bool      `json:"automatic"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var (
+	relayMu     sync.Mutex
+	relayRules  []*RelayRule
+	relayNextID = 1
+)
+
+// loadRelayRules reads the initial rule set from RELAY_RULES_FILE (a JSON
+// array) and RELAY_RULES (the same JSON inline).
+func loadRelayRules() error {
+	switch mode := getEnv("RELAY_TLS", relayTLSNone); mode {
+	case relayTLSNone, relayTLSStartTLS, relayTLSImplicit:
+	default:
+		return fmt.Errorf("invalid RELAY_TLS %q, expected none, starttls or tls", mode)
+	}
+
+	rules, err := loadRulesFromEnv[RelayRule]("RELAY_RULES_FILE", "RELAY_RULES")
+	if err != nil {
+		return err
+	}
+	if len(rules) > 0 && getEnv("RELAY_HOST", "") == "" {
+		return errRelayNotConfigured
+	}
+
+	for _, rule := range rules {
+		addRelayRule(rule)
+	}
+	if len(rules) > 0 {
+		log.Printf("Loaded %d relay rules", len(rules))
+	}
+	return nil
+}
+
+func addRelayRule(rule RelayRule) *RelayRule {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+
+	rule.ID = relayNextID
+	relayNextID++
+	relayRules = append(relayRules, &rule)
+	created := rule
+	return &created
+}
+
+func listRelayRules() []RelayRule {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+
+	rules := []RelayRule{}
+	for _, rule := range relayRules {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+func deleteRelayRule(id int) bool {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+
+	for i, rule := range relayRules {
+		if rule.ID == id {
+			relayRules = append(relayRules[:i], relayRules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func clearRelayRules() {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+
+	relayRules = nil
+}
+
+// relayRecipientsFor returns the recipients of the first matching rule, or
+// nil when the message should not be relayed.
+func relayRecipientsFor(from string, to []string) []string {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+
+	for _, rule := range relayRules {
+		if !matchPattern(rule.Sender, from) || !matchAnyPattern(rule.Recipient, to) {
+			continue
+		}
+		if len(rule.To) > 0 {
+			return append([]string(nil), rule.To...)
+		}
+		return to
+	}
+	return nil
+}
+
+// autoRelay releases a just stored message when a relay rule matches.
+func autoRelay(email *Email) {
+	to := relayRecipientsFor(email.FromEmail, email.Envelope.RcptTo)
+	if to == nil {
+		return
+	}
+
+	delivery, err := relayMessage(email.ID, email.FromEmail, to, email.Raw, true)
+	if err != nil {
+		log.Printf("Error relaying email %d: %v", email.ID, err)
+		return
+	}
+	if delivery.Status == deliveryFailed {
+		log.Printf("Relaying email %d to %s failed: %s", email.ID, strings.Join(to, ","), delivery.Error)
+		return
+	}
+	log.Printf("Relayed email %d to %s", email.ID, strings.Join(to, ","))
+}
+
+// relayMessage sends the raw message upstream and records the outcome. The
+// returned error is only set when the attempt could not be recorded.
+func relayMessage(emailID int, from string, to []string, raw []byte, automatic bool) (*Delivery, error) {
+	delivery := &Delivery{
+		EmailID:   emailID,
+		RcptTo:    to,
+		Status:    deliverySent,
+		Automatic: automatic,
+	}
+	if err := sendUpstream(from, to, raw); err != nil {
+		delivery.Status = deliveryFailed
+		delivery.Error = err.Error()
+	}
+
+	if err := createDelivery(delivery); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// sendUpstream delivers the message through RELAY_HOST, using RELAY_TLS and
+// the RELAY_USERNAME credentials when set.
+func sendUpstream(from string, to []string, raw []byte) error {
+	host := getEnv("RELAY_HOST", "")
+	if host == "" {
+		return errRelayNotConfigured
+	}
+	addr := net.JoinHostPort(host, getEnv("RELAY_PORT", "25"))
+	mode := getEnv("RELAY_TLS", relayTLSNone)
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: getEnv("RELAY_TLS_SKIP_VERIFY", "") == "true",
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if mode == relayTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	var c *smtp.Client
+	if mode == relayTLSStartTLS {
+		c, err = smtp.NewClientStartTLS(conn, tlsConfig)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		c = smtp.NewClient(conn)
+	}
+	defer c.Close()
+
+	if username := getEnv("RELAY_USERNAME", ""); username != "" {
+		if err := c.Auth(sasl.NewPlainClient("", username, getEnv("RELAY_PASSWORD", ""))); err != nil {
+			return err
+		}
+	}
+
+	opts := &smtp.MailOptions{UTF8: !isASCII(from)}
+	for _, rcpt := range to {
+		opts.UTF8 = opts.UTF8 || !isASCII(rcpt)
+	}
+	if err := c.Mail(from, opts); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, bytes.NewReader(raw)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func createDelivery(d *Delivery) error {
+	result, err := db.Exec(`
+		INSERT INTO relay_deliveries (email_id, rcpt_to, status, error, automatic)
+		VALUES (?, ?, ?, ?, ?)
+	`, d.EmailID, strings.Join(d.RcptTo, ","), d.Status, d.Error, d.Automatic)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	d.ID = int(id)
+	d.CreatedAt = time.Now()
+	return nil
+}
+
+func getDeliveriesByEmail(emailID int) ([]Delivery, error) {
+	rows, err := db.Query(`
+		SELECT id, email_id, rcpt_to, status, COALESCE(error, ''), automatic, created_at
+		FROM relay_deliveries
+		WHERE email_id = ?
+		ORDER BY id
+	`, emailID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		var rcptTo string
+		if err := rows.Scan(&d.ID, &d.EmailID, &rcptTo, &d.Status, &d.Error, &d.Automatic, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		d.RcptTo = strings.Split(rcptTo, ",")
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, nil
+}
+
+// handleReleaseEmail relays a stored message upstream, to the recipient it
+// was delivered to in the user's inbox. Admins can release it to any
+// recipients in the request body instead.
+func handleReleaseEmail(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	emailID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email ID"})
+		return
+	}
+
+	var req struct {
+		To []string `json:"to"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if getEnv("RELAY_HOST", "") == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Relay is not configured"})
+		return
+	}
+
+	email, err := getEmailByID(emailID, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+	raw, err := getEmailRaw(emailID, userID)
+	if err != nil || len(raw) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Raw message not available for this email"})
+		return
+	}
+
+	// Other addresses would send the message out with the shared upstream
+	// credentials, or to the other recipients of the message
+	to := []string{email.ToEmail}
+	if len(req.To) > 0 {
+		if !isAdmin(c.GetString("user_email")) && (len(req.To) > 1 || !strings.EqualFold(req.To[0], email.ToEmail)) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can release to other recipients"})
+			return
+		}
+		to = req.To
+	}
+
+	delivery, err := relayMessage(email.ID, email.FromEmail, to, raw, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record delivery"})
+		return
+	}
+	if delivery.Status == deliveryFailed {
+		c.JSON(http.StatusBadGateway, delivery)
+		return
+	}
+
+	c.JSON(http.StatusOK, delivery)
+}
+
+func handleGetRelayRules(c *gin.Context) {
+	c.JSON(http.StatusOK, listRelayRules())
+}
+
+func handleCreateRelayRule(c *gin.Context) {
+	var rule RelayRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid relay rule"})
+		return
+	}
+	if getEnv("RELAY_HOST", "") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errRelayNotConfigured.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, addRelayRule(rule))
+}
+
+func handleDeleteRelayRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid relay rule ID"})
+		return
+	}
+
+	if !deleteRelayRule(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Relay rule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Relay rule deleted successfully"})
+}
+
+func handleClearRelayRules(c *gin.Context) {
+	clearRelayRules()
+	c.JSON(http.StatusOK, gin.H{"message": "Relay rules cleared successfully"})
+}
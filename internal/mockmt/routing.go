@@ -0,0 +1,192 @@
+package mockmt
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+	"github.com/gin-gonic/gin"
+)
+
+// RoutingRule delivers recipients matching a glob Pattern or a Regex to the
+// Deliver inbox. With Regex, Deliver may reference capture groups ($1).
+type RoutingRule struct {
+	ID      int    `json:"id"`
+	Pattern string `json:"pattern"`
+	Regex   string `json:"regex"`
+	Deliver string `json:"deliver"`
+
+	re *regexp.Regexp
+}
+
+var (
+	routingMu       sync.Mutex
+	routingRules    []*RoutingRule
+	routingNextID   = 1
+	acceptedDomains []string
+	catchAllInbox   string
+)
+
+// loadRoutingConfig reads ACCEPTED_DOMAINS, CATCH_ALL_INBOX and the initial
+// rule set from ROUTING_RULES_FILE and ROUTING_RULES.
+func loadRoutingConfig() error {
+	for _, domain := range strings.Split(getEnv("ACCEPTED_DOMAINS", ""), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			acceptedDomains = append(acceptedDomains, domain)
+		}
+	}
+	catchAllInbox = getEnv("CATCH_ALL_INBOX", "")
+
+	rules, err := loadRulesFromEnv[RoutingRule]("ROUTING_RULES_FILE", "ROUTING_RULES")
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if _, err := addRoutingRule(rule); err != nil {
+			return err
+		}
+	}
+	if len(rules) > 0 {
+		log.Printf("Loaded %d recipient routing rules", len(rules))
+	}
+	return nil
+}
+
+func addRoutingRule(rule RoutingRule) (*RoutingRule, error) {
+	if (rule.Pattern == "") == (rule.Regex == "") {
+		return nil, fmt.Errorf("exactly one of pattern or regex is required")
+	}
+	if rule.Deliver == "" {
+		return nil, fmt.Errorf("deliver inbox is required")
+	}
+	if rule.Regex != "" {
+		re, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		rule.re = re
+	}
+
+	routingMu.Lock()
+	defer routingMu.Unlock()
+
+	rule.ID = routingNextID
+	routingNextID++
+	routingRules = append(routingRules, &rule)
+	created := rule
+	return &created, nil
+}
+
+func listRoutingRules() []RoutingRule {
+	routingMu.Lock()
+	defer routingMu.Unlock()
+
+	rules := []RoutingRule{}
+	for _, rule := range routingRules {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+func deleteRoutingRule(id int) bool {
+	routingMu.Lock()
+	defer routingMu.Unlock()
+
+	for i, rule := range routingRules {
+		if rule.ID == id {
+			routingRules = append(routingRules[:i], routingRules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func clearRoutingRules() {
+	routingMu.Lock()
+	defer routingMu.Unlock()
+
+	routingRules = nil
+}
+
+// routeRecipient returns the inbox a recipient is delivered to. Routing rules
+// come first, then the accepted domains, then the catch-all inbox; recipients
+// matching none of them are rejected.
+func routeRecipient(rcpt string) (string, error) {
+	routingMu.Lock()
+	defer routingMu.Unlock()
+
+	for _, rule := range routingRules {
+		if rule.re != nil {
+			if rule.re.MatchString(rcpt) {
+				return rule.re.ReplaceAllString(rcpt, rule.Deliver), nil
+			}
+		} else if matchPattern(rule.Pattern, rcpt) {
+			return rule.Deliver, nil
+		}
+	}
+
+	if len(acceptedDomains) == 0 {
+		return rcpt, nil
+	}
+	for _, domain := range acceptedDomains {
+		if matchPattern(domain, addressDomain(rcpt)) {
+			return rcpt, nil
+		}
+	}
+
+	if catchAllInbox != "" {
+		return catchAllInbox, nil
+	}
+
+	return "", &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      fmt.Sprintf("Relay access denied for domain %s", addressDomain(rcpt)),
+	}
+}
+
+func handleGetRoutingRules(c *gin.Context) {
+	c.JSON(http.StatusOK, listRoutingRules())
+}
+
+func handleCreateRoutingRule(c *gin.Context) {
+	var rule RoutingRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid routing rule"})
+		return
+	}
+
+	created, err := addRoutingRule(rule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, created)
+}
+
+func handleDeleteRoutingRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid routing rule ID"})
+		return
+	}
+
+	if !deleteRoutingRule(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Routing rule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Routing rule deleted successfully"})
+}
+
+func handleClearRoutingRules(c *gin.Context) {
+	clearRoutingRules()
+	c.JSON(http.StatusOK, gin.H{"message": "Routing rules cleared successfully"})
+}
@@ -0,0 +1,288 @@
+package mockmt
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ftsEnabled is set when SQLite was built with FTS5 (the sqlite_fts5 build
+// tag of go-sqlite3). Without it, search terms are matched with LIKE.
+var ftsEnabled bool
+
+// createSearchIndex creates the full-text index of emails, keyed by email
+// ID, and indexes the emails stored before it existed.
+func createSearchIndex() error {
+	// Checked up front, as an index created by a build with FTS5 is still
+	// there but unusable when the database is opened by one without it
+	var available bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pragma_module_list WHERE name = 'fts5')`).Scan(&available)
+	if err != nil {
+		return err
+	}
+	if !available {
+		log.Printf("SQLite was built without FTS5, searching emails without an index")
+		ftsEnabled = false
+		return nil
+	}
+
+	_, err = db.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS email_search USING fts5 (
+			subject, body, html_text, addresses, attachments,
+			tokenize = 'unicode61 remove_diacritics 2'
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	ftsEnabled = true
+
+	rows, err := db.Query(`
+		SELECT id, subject, body, COALESCE(html_body, ''), from_email, to_email
+		FROM emails
+		WHERE id NOT IN (SELECT rowid FROM email_search)
+	`)
+	if err != nil {
+		return err
+	}
+	var emails []Email
+	for rows.Next() {
+		var email Email
+		if err := rows.Scan(&email.ID, &email.Subject, &email.Body, &email.HTMLBody, &email.FromEmail, &email.ToEmail); err != nil {
+			rows.Close()
+			return err
+		}
+		emails = append(emails, email)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range emails {
+		email := &emails[i]
+		if err := loadEmailAddresses(email); err != nil {
+			return err
+		}
+		if len(email.Envelope.RcptTo) == 0 {
+			email.Envelope.RcptTo = strings.Split(email.ToEmail, ", ")
+		}
+		if email.Attachments, err = getAttachmentsByEmail(email.ID); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := range emails {
+		if err := indexEmail(tx, &emails[i]); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(emails) > 0 {
+		log.Printf("Indexed %d emails for search", len(emails))
+	}
+
+	return nil
+}
+
+// indexEmail adds an email to the full-text index, with its HTML body
+// stripped to text.
+func indexEmail(tx *sql.Tx, email *Email) error {
+	if !ftsEnabled {
+		return nil
+	}
+
+	addresses := []string{email.FromEmail}
+	if email.Envelope != nil {
+		addresses = append(addresses, email.Envelope.RcptTo...)
+	}
+	for _, list := range [][]Address{email.HeaderFrom, email.HeaderTo, email.HeaderCc, email.HeaderReplyTo} {
+		for _, a := range list {
+			addresses = append(addresses, a.Name, a.Address)
+		}
+	}
+
+	var filenames []string
+	for _, a := range email.Attachments {
+		filenames = append(filenames, a.Filename)
+	}
+
+	htmlText := ""
+	if email.HTMLBody != "" {
+		htmlText = htmlToText(email.HTMLBody)
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO email_search (rowid, subject, body, html_text, addresses, attachments)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, email.ID, email.Subject, email.Body, htmlText, strings.Join(addresses, " "), strings.Join(filenames, " "))
+	return err
+}
+
+// applySearchQuery adds a Gmail-like search query to a filter. Words and
+// quoted phrases must all appear in the subject, bodies, addresses or
+// attachment filenames, and the operators from:, to:, subject:, before:,
+// after:, has:attachment and is:read or is:unread narrow the results like the
+// filters of the email list. Dates are written as 2024/06/01 or 2024-06-01.
+func applySearchQuery(f *EmailFilter, q string) error {
+	seen := map[string]bool{}
+	for _, term := range splitSearchQuery(q) {
+		operator, value, ok := strings.Cut(term, ":")
+		operator = strings.ToLower(operator)
+		if !ok || strings.HasPrefix(term, `"`) || !isSearchOperator(operator) {
+			if phrase := strings.Trim(term, `"`); phrase != "" {
+				f.Terms = append(f.Terms, phrase)
+			}
+			continue
+		}
+
+		value = strings.Trim(value, `"`)
+		if value == "" {
+			return fmt.Errorf("%s: needs a value", operator)
+		}
+		if seen[operator] && operator != "has" && operator != "is" {
+			return fmt.Errorf("%s: can only be used once", operator)
+		}
+		seen[operator] = true
+
+		var err error
+		switch operator {
+		case "from":
+			f.From = value
+		case "to":
+			f.To = value
+		case "subject":
+			f.Subject = value
+		case "after":
+			f.Since, err = parseEmailTime(strings.ReplaceAll(value, "/", "-"), false)
+		case "before":
+			f.Until, err = parseEmailTime(strings.ReplaceAll(value, "/", "-"), false)
+		case "has":
+			if !strings.EqualFold(value, "attachment") {
+				return fmt.Errorf("unsupported has:%s, expected has:attachment", value)
+			}
+			hasAttachment := true
+			f.HasAttachment = &hasAttachment
+		case "is":
+			var read bool
+			switch strings.ToLower(value) {
+			case "read":
+				read = true
+			case "unread":
+				read = false
+			default:
+				return fmt.Errorf("unsupported is:%s, expected is:read or is:unread", value)
+			}
+			f.Read = &read
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", operator, err)
+		}
+	}
+	return nil
+}
+
+func isSearchOperator(operator string) bool {
+	switch operator {
+	case "from", "to", "subject", "after", "before", "has", "is":
+		return true
+	}
+	return false
+}
+
+// splitSearchQuery splits a query at whitespace outside double quotes, so
+// that "a phrase" and subject:"a phrase" are single terms.
+func splitSearchQuery(q string) []string {
+	var terms []string
+	var b strings.Builder
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			b.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if b.Len() > 0 {
+				terms = append(terms, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() > 0 {
+		terms = append(terms, b.String())
+	}
+	return terms
+}
+
+// ftsQuery writes search terms as an FTS5 query matching all of them, each as
+// a quoted string so that their characters have no special meaning.
+func ftsQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// searchTermsCondition returns the SQL condition and arguments matching
+// emails that contain all search terms.
+func searchTermsCondition(terms []string) (string, []any) {
+	if ftsEnabled {
+		return ` AND e.id IN (SELECT rowid FROM email_search WHERE email_search MATCH ?)`, []any{ftsQuery(terms)}
+	}
+
+	condition := ""
+	var args []any
+	for _, term := range terms {
+		condition += ` AND (e.subject LIKE ? ESCAPE '\' OR e.body LIKE ? ESCAPE '\' OR e.html_body LIKE ? ESCAPE '\'
+			OR e.from_email LIKE ? ESCAPE '\' OR e.to_email LIKE ? ESCAPE '\'
+			OR EXISTS (SELECT 1 FROM email_addresses a WHERE a.email_id = e.id AND (a.address LIKE ? ESCAPE '\' OR a.name LIKE ? ESCAPE '\'))
+			OR EXISTS (SELECT 1 FROM attachments a WHERE a.email_id = e.id AND a.filename LIKE ? ESCAPE '\'))`
+		pattern := likeContains(term)
+		for range 8 {
+			args = append(args, pattern)
+		}
+	}
+	return condition, args
+}
+
+func handleSearch(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+
+	filter, err := parseEmailFilter(c)
+	if err == nil {
+		err = applySearchQuery(filter, q)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, err := listEmails(userID, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search emails"})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
@@ -0,0 +1,154 @@
+package mockmt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplySearchQuery(t *testing.T) {
+	yes, no := true, false
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  EmailFilter
+	}{
+		{
+			name:  "words",
+			query: "invoice  overdue",
+			want:  EmailFilter{Terms: []string{"invoice", "overdue"}},
+		},
+		{
+			name:  "quoted phrase",
+			query: `"weekly report" draft`,
+			want:  EmailFilter{Terms: []string{"weekly report", "draft"}},
+		},
+		{
+			name:  "operators",
+			query: "from:alice@example.com to:bob subject:hello",
+			want:  EmailFilter{From: "alice@example.com", To: "bob", Subject: "hello"},
+		},
+		{
+			name:  "operator names are case-insensitive",
+			query: "FROM:alice Subject:Hello",
+			want:  EmailFilter{From: "alice", Subject: "Hello"},
+		},
+		{
+			name:  "quoted operator value",
+			query: `subject:"weekly report" from:"Alice Smith"`,
+			want:  EmailFilter{Subject: "weekly report", From: "Alice Smith"},
+		},
+		{
+			name:  "quoted operator is a phrase",
+			query: `"from:alice" hello`,
+			want:  EmailFilter{Terms: []string{"from:alice", "hello"}},
+		},
+		{
+			name:  "unknown operator is a word",
+			query: "label:work https://example.com",
+			want:  EmailFilter{Terms: []string{"label:work", "https://example.com"}},
+		},
+		{
+			name:  "dates with slashes and dashes",
+			query: "after:2024/06/01 before:2024-06-30",
+			want:  EmailFilter{Since: date(2024, 6, 1), Until: date(2024, 6, 30)},
+		},
+		{
+			name:  "has and is",
+			query: "has:attachment is:unread",
+			want:  EmailFilter{HasAttachment: &yes, Read: &no},
+		},
+		{
+			name:  "has and is can be repeated",
+			query: "is:unread is:READ has:Attachment has:attachment",
+			want:  EmailFilter{HasAttachment: &yes, Read: &yes},
+		},
+		{
+			name:  "unbalanced quote runs to the end",
+			query: `hello "unfinished phrase`,
+			want:  EmailFilter{Terms: []string{"hello", "unfinished phrase"}},
+		},
+		{
+			name:  "unbalanced quote in an operator value",
+			query: `subject:"unfinished value`,
+			want:  EmailFilter{Subject: "unfinished value"},
+		},
+		{
+			name:  "empty phrase is ignored",
+			query: `"" hello`,
+			want:  EmailFilter{Terms: []string{"hello"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f EmailFilter
+			if err := applySearchQuery(&f, tt.query); err != nil {
+				t.Fatalf("applySearchQuery(%q): %v", tt.query, err)
+			}
+			if !reflect.DeepEqual(f, tt.want) {
+				t.Errorf("applySearchQuery(%q):\n got %+v\nwant %+v", tt.query, f, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplySearchQueryErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{name: "repeated from", query: "from:a from:b", want: "from: can only be used once"},
+		{name: "repeated in another case", query: "subject:a SUBJECT:b", want: "subject: can only be used once"},
+		{name: "repeated date", query: "after:2024/01/01 after:2024/02/01", want: "after: can only be used once"},
+		{name: "missing value", query: "to: hello", want: "to: needs a value"},
+		{name: "empty quoted value", query: `subject:""`, want: "subject: needs a value"},
+		{name: "invalid date", query: "before:yesterday", want: "before: expected a date"},
+		{name: "unsupported has", query: "has:image", want: "unsupported has:image"},
+		{name: "unsupported is", query: "is:starred", want: "unsupported is:starred"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f EmailFilter
+			err := applySearchQuery(&f, tt.query)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("applySearchQuery(%q) = %v, want error containing %q", tt.query, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitSearchQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "", want: nil},
+		{query: "  a \t b\n", want: []string{"a", "b"}},
+		{query: `"a b" c`, want: []string{`"a b"`, "c"}},
+		{query: `subject:"a b" c`, want: []string{`subject:"a b"`, "c"}},
+		{query: `a"b c"d e`, want: []string{`a"b c"d`, "e"}},
+		{query: `"a b`, want: []string{`"a b`}},
+	}
+
+	for _, tt := range tests {
+		if got := splitSearchQuery(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitSearchQuery(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestFTSQuery(t *testing.T) {
+	got := ftsQuery([]string{"hello", `say "hi"`, "from:x"})
+	want := `"hello" "say ""hi""" "from:x"`
+	if got != want {
+		t.Errorf("ftsQuery = %s, want %s", got, want)
+	}
+}
@@ -1,106 +1,339 @@
 package mockmt
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"strings"
+	"time"
 
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
 	"github.com/emersion/go-message/mail"
 	"github.com/emersion/go-smtp"
 )
 
 var ErrInvalidAddress = errors.New("invalid address")
 
-type Backend struct{}
+// smtpDomain is the name the server greets with and reports results as.
+const smtpDomain = "localhost"
+
+type Backend struct {
+	greylist      bool
+	greylistDelay time.Duration
+	requireTLS    bool
+	authRequired  bool
+	authCRAMMD5   bool
+}
 
 func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &Session{}, nil
+	s := &Session{backend: bkd, conn: c, transcript: transcriptFor(c.Conn().RemoteAddr())}
+	if s.transcript != nil {
+		s.transcript.session(c)
+	}
+	return s, nil
 }
 
 type Session struct {
-	from string
-	to   []string
-}
+	backend  *Backend
+	conn     *smtp.Conn
+	authUser string
+	from     string
+	to       []string
+	inboxes  []string // delivery inbox of each recipient in to
 
-func (s *Session) AuthPlain(username, password string) error {
-	return nil // No authentication required
+	// ESMTP extensions the client used for the current message
+	extensions []string
+
+	// transcript of the connection, nil when transcripts are disabled
+	transcript *transcriptRecorder
 }
 
-func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+func (s *Session) Mail(from string, opts *smtp.MailOptions) (err error) {
+	defer func() { s.trace("MAIL FROM:<"+from+">", err) }()
+
+	if s.backend.requireTLS {
+		if _, isTLS := s.conn.TLSConnectionState(); !isTLS {
+			return errTLSRequired
+		}
+	}
+	if s.backend.authRequired && s.authUser == "" {
+		return errAuthRequired
+	}
+	if err := checkFaults(stageMail, from, nil); err != nil {
+		return err
+	}
 	s.from = from
+
+	if opts != nil {
+		if opts.UTF8 {
+			s.extensions = append(s.extensions, "SMTPUTF8")
+		}
+		if opts.Body == smtp.Body8BitMIME || opts.Body == smtp.BodyBinaryMIME {
+			s.extensions = append(s.extensions, string(opts.Body))
+		}
+		if opts.Size > 0 {
+			s.extensions = append(s.extensions, "SIZE")
+		}
+	}
 	return nil
 }
 
-func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	// if !strings.HasSuffix(to, "@localhost") {
-	// 	return &smtp.SMTPError{
-	// 		Code:    550,
-	// 		Message: "Invalid address",
-	// 	}
-	// }
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) (err error) {
+	defer func() { s.trace("RCPT TO:<"+to+">", err) }()
+
+	if err := checkFaults(stageRcpt, s.from, []string{to}); err != nil {
+		return err
+	}
+	inbox, err := routeRecipient(to)
+	if err != nil {
+		return err
+	}
+	if s.backend.greylist {
+		if err := checkGreylist(remoteIP(s.conn.Conn().RemoteAddr()), s.from, to, s.backend.greylistDelay); err != nil {
+			return err
+		}
+	}
 	s.to = append(s.to, to)
+	s.inboxes = append(s.inboxes, inbox)
+
+	if rule := latencyRuleFor([]string{to}); rule != nil && rule.RcptDelayMs > 0 {
+		time.Sleep(time.Duration(rule.RcptDelayMs) * time.Millisecond)
+	}
 	return nil
 }
 
-func (s *Session) Data(r io.Reader) error {
-	mr, err := mail.CreateReader(r)
+func (s *Session) Data(r io.Reader) (err error) {
+	defer func() { s.trace("DATA", err) }()
+
+	if err := checkFaults(stageData, s.from, s.to); err != nil {
+		return err
+	}
+	return s.receive(r, s.to, s.inboxes)
+}
+
+// LMTPData reports a status per recipient. Fault rules for the data stage
+// are checked for each recipient on its own, so one recipient can fail while
+// the message is delivered to the others. A rule's every_nth therefore counts
+// recipients rather than messages.
+func (s *Session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	var to, inboxes []string
+	replies := make([]error, len(s.to))
+	defer func() { s.trace("DATA", replies...) }()
+
+	for i, rcpt := range s.to {
+		if err := checkFaults(stageData, s.from, []string{rcpt}); err != nil {
+			status.SetStatus(rcpt, err)
+			replies[i] = err
+			continue
+		}
+		to = append(to, rcpt)
+		inboxes = append(inboxes, s.inboxes[i])
+	}
+	if len(to) == 0 {
+		// The message must still be read, or a BDAT transfer fails before
+		// the replies are sent
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			log.Printf("Error reading message data: %v", err)
+		}
+		return nil
+	}
+
+	err := s.receive(r, to, inboxes)
+	for i, rcpt := range s.to {
+		if replies[i] == nil {
+			status.SetStatus(rcpt, err)
+			replies[i] = err
+		}
+	}
+	return nil
+}
+
+// receive reads, parses and stores a message for the given recipients, each
+// delivered to the inbox at the same index.
+func (s *Session) receive(r io.Reader, to, inboxes []string) error {
+	// go-smtp hands the body of BDAT transfers over through a pipe
+	extensions := s.extensions
+	if _, ok := r.(*io.PipeReader); ok {
+		extensions = append(extensions, "CHUNKING")
+	}
+	if s.transcript != nil {
+		s.transcript.useExtensions(extensions...)
+	}
+
+	latency := latencyRuleFor(to)
+	if latency != nil && latency.DropDuringData {
+		return dropDuringData(s.conn.Conn(), r, latency.DropAfterBytes)
+	}
+
+	// Keep the original bytes so the exact source can be served later
+	raw, err := io.ReadAll(r)
 	if err != nil {
-		log.Printf("Error creating mail reader: %v", err)
+		log.Printf("Error reading message data: %v", err)
 		return err
 	}
 
-	header := mr.Header
-	subject := header.Get("Subject")
+	entity, err := message.Read(bytes.NewReader(raw))
+	if message.IsUnknownCharset(err) {
+		log.Printf("Unknown charset, keeping message body undecoded: %v", err)
+	} else if err != nil {
+		log.Printf("Error parsing message: %v", err)
+		return err
+	}
+
+	header := mail.Header{Header: entity.Header}
+	// Subject decodes RFC 2047 encoded-words and falls back to the raw value
+	subject, err := header.Subject()
+	if err != nil {
+		log.Printf("Error decoding subject: %v", err)
+	}
 	if subject == "" {
 		subject = "No Subject"
 	}
 
-	body := ""
-	htmlBody := ""
-
-	for {
-		p, err := mr.NextPart()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Printf("Error reading part: %v", err)
-			break
-		}
+	originalMessageID, _ := header.MessageID()
+	headerFrom := parseAddressList(header, "From")
+	headerTo := parseAddressList(header, "To")
+	headerCc := parseAddressList(header, "Cc")
+	headerReplyTo := parseAddressList(header, "Reply-To")
+	bcc := bccRecipients(to, headerTo, headerCc)
 
-		switch h := p.Header.(type) {
-		case *mail.InlineHeader:
-			contentType, _, _ := h.ContentType()
-			if strings.HasPrefix(contentType, "text/plain") {
-				b, _ := io.ReadAll(p.Body)
-				body = string(b)
-			} else if strings.HasPrefix(contentType, "text/html") {
-				b, _ := io.ReadAll(p.Body)
-				htmlBody = string(b)
+	headers := []EmailHeader{}
+	fields := header.Fields()
+	for fields.Next() {
+		// Keep the header name as the sender wrote it rather than canonicalized
+		name := fields.Key()
+		if rawField, err := fields.Raw(); err == nil {
+			if i := bytes.IndexByte(rawField, ':'); i > 0 {
+				name = string(bytes.TrimSpace(rawField[:i]))
 			}
-		case *mail.AttachmentHeader:
-			// We can handle attachments here in the future
 		}
+		headers = append(headers, EmailHeader{Name: name, Value: fields.Value()})
 	}
 
+	var parser mimeParser
+	parts := parser.walk(entity, "1", false)
+	attachments := parser.attachments
+
+	// Multiple inline text parts, e.g. around an attachment, are joined
+	body := strings.Join(parser.body, "\n")
+	htmlBody := strings.Join(parser.htmlBody, "\n")
+	bodyDerived := false
 	if body == "" && htmlBody != "" {
-		body = stripHTML(htmlBody)
+		body = htmlToText(htmlBody)
+		bodyDerived = true
+	}
+	charset := parser.charset
+	if charset == "" {
+		charset = parser.htmlCharset
 	}
 
-	for _, to := range s.to {
-		if err := saveEmail(s.from, to, subject, body, htmlBody); err != nil {
-			log.Printf("Error saving email: %v", err)
-			return err
+	email := &Email{
+		OriginalMessageID: originalMessageID,
+		FromEmail:         s.from,
+		Subject:           subject,
+		Body:              body,
+		BodyDerived:       bodyDerived,
+		HTMLBody:          htmlBody,
+		Raw:               raw,
+		Attachments:       attachments,
+		Headers:           headers,
+		Envelope:          &Envelope{MailFrom: s.from, RcptTo: to},
+		Inboxes:           inboxes,
+		HeaderFrom:        headerFrom,
+		HeaderTo:          headerTo,
+		HeaderCc:          headerCc,
+		HeaderReplyTo:     headerReplyTo,
+		Bcc:               bcc,
+		AuthUser:          s.authUser,
+		ClientIP:          remoteIP(s.conn.Conn().RemoteAddr()),
+		SMTPExtensions:    extensions,
+		Charset:           charset,
+		Parts:             &parts,
+		DKIM:              verifyDKIM(raw, entity.Header),
+	}
+	email.Authentication = checkAuthentication(email.ClientIP, s.conn.Hostname(), s.from, headerFrom, email.DKIM)
+	if s.transcript != nil {
+		email.TranscriptID = s.transcript.t.ID
+		email.TranscriptPos = s.transcript.transactionStart()
+	}
+	if err := saveEmail(email); err != nil {
+		log.Printf("Error saving email: %v", err)
+		return err
+	}
+	log.Printf("Email saved: from=%s, to=%s, subject=%s, attachments=%d", s.from, strings.Join(to, ","), subject, len(attachments))
+	notifyEmailStored()
+	go autoRelay(email)
+
+	if latency != nil {
+		if latency.DataDelayMs > 0 {
+			time.Sleep(time.Duration(latency.DataDelayMs) * time.Millisecond)
+		}
+		if latency.HangAfterData {
+			hangUntilClosed(s.conn.Conn())
 		}
-		log.Printf("Email saved: from=%s, to=%s, subject=%s", s.from, to, subject)
 	}
 
 	return nil
 }
 
+func parseAddressList(h mail.Header, key string) []Address {
+	list, err := h.AddressList(key)
+	if err != nil {
+		log.Printf("Error parsing %s header: %v", key, err)
+		return nil
+	}
+
+	addresses := []Address{}
+	for _, a := range list {
+		addresses = append(addresses, Address{Name: a.Name, Address: a.Address})
+	}
+	return addresses
+}
+
+// bccRecipients returns the envelope recipients that do not appear in any of
+// the given header address lists.
+func bccRecipients(rcptTo []string, lists ...[]Address) []string {
+	var header []string
+	for _, list := range lists {
+		for _, a := range list {
+			header = append(header, a.Address)
+		}
+	}
+
+	bcc := []string{}
+	for _, rcpt := range rcptTo {
+		if !containsAddress(header, rcpt) {
+			bcc = append(bcc, rcpt)
+		}
+	}
+	return bcc
+}
+
+func containsAddress(addresses []string, address string) bool {
+	for _, a := range addresses {
+		if strings.EqualFold(a, address) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Session) Reset() {
 	s.from = ""
 	s.to = nil
+	s.inboxes = nil
+	s.extensions = nil
+}
+
+// trace records a command and its replies in the connection's transcript.
+func (s *Session) trace(command string, replies ...error) {
+	if s.transcript != nil {
+		s.transcript.command(command, replies...)
+	}
 }
 
 func (s *Session) Logout() error {
@@ -108,37 +341,123 @@ func (s *Session) Logout() error {
 }
 
 func StartSMTPServer() error {
-	be := &Backend{}
+	if err := loadFaultRules(); err != nil {
+		return err
+	}
+	if err := loadLatencyRules(); err != nil {
+		return err
+	}
+	if err := loadRoutingConfig(); err != nil {
+		return err
+	}
+	if err := loadRelayRules(); err != nil {
+		return err
+	}
+	if err := loadDNSRecords(); err != nil {
+		return err
+	}
 
-	s := smtp.NewServer(be)
+	be := &Backend{
+		greylist:      getEnv("GREYLIST_ENABLED", "") == "true",
+		greylistDelay: getEnvDuration("GREYLIST_DELAY", 5*time.Minute),
+		authRequired:  getEnv("SMTP_AUTH_REQUIRED", "") == "true",
+		authCRAMMD5:   getEnv("SMTP_AUTH_CRAM_MD5", "") == "true",
+	}
+	if be.greylist {
+		log.Printf("Greylisting enabled with a %s retry window", be.greylistDelay)
+	}
+
+	var tlsConfig *tls.Config
+	startTLS := getEnv("SMTP_STARTTLS", "") == "true"
+	smtpsPort := getEnv("SMTPS_PORT", "")
+	if startTLS || smtpsPort != "" {
+		var err error
+		tlsConfig, err = loadTLSConfig()
+		if err != nil {
+			return err
+		}
+	}
+	if getEnv("SMTP_REQUIRE_TLS", "") == "true" {
+		if !startTLS {
+			return fmt.Errorf("SMTP_REQUIRE_TLS needs SMTP_STARTTLS=true")
+		}
+		be.requireTLS = true
+	}
+
+	proxyPolicy, err := loadProxyPolicy()
+	if err != nil {
+		return err
+	}
 
+	s := newSMTPServer(be)
 	smtpPort := getEnv("SMTP_PORT", "25")
 	s.Addr = ":" + smtpPort
-	s.Domain = "localhost"
-	s.AllowInsecureAuth = true
+	if startTLS {
+		s.TLSConfig = tlsConfig
+	}
 
-	log.Printf("Starting SMTP server at %s", s.Addr)
-	return s.ListenAndServe()
-}
+	l, err := listenSMTP(s.Addr, proxyPolicy)
+	if err != nil {
+		return err
+	}
+
+	errc := make(chan error, 3)
+
+	log.Printf("Starting SMTP server at %s (STARTTLS: %t)", s.Addr, startTLS)
+	go func() {
+		errc <- s.Serve(&latencyListener{Listener: &transcriptListener{Listener: l, name: "smtp"}})
+	}()
 
-func stripHTML(html string) string {
-	// Simple HTML stripping - remove tags
-	result := html
-	result = strings.ReplaceAll(result, "<br>", "\n")
-	result = strings.ReplaceAll(result, "<br/>", "\n")
-	result = strings.ReplaceAll(result, "<br />", "\n")
+	if smtpsPort != "" {
+		ts := newSMTPServer(be)
+		ts.Addr = ":" + smtpsPort
+		ts.TLSConfig = tlsConfig
 
-	for {
-		start := strings.Index(result, "<")
-		if start == -1 {
-			break
+		tl, err := listenSMTP(ts.Addr, proxyPolicy)
+		if err != nil {
+			return err
 		}
-		end := strings.Index(result[start:], ">")
-		if end == -1 {
-			break
+
+		log.Printf("Starting SMTPS server at %s", ts.Addr)
+		go func() {
+			errc <- ts.Serve(tls.NewListener(&latencyListener{Listener: &transcriptListener{Listener: tl, name: "smtps", encrypted: true}}, tlsConfig))
+		}()
+	}
+
+	if lmtpPort := getEnv("LMTP_PORT", ""); lmtpPort != "" {
+		// LMTP is a local delivery hop, so TLS, AUTH and greylisting are left
+		// to the MTA in front of it
+		ls := newSMTPServer(&Backend{})
+		ls.Addr = ":" + lmtpPort
+		ls.LMTP = true
+
+		ll, err := listenSMTP(ls.Addr, proxyPolicy)
+		if err != nil {
+			return err
 		}
-		result = result[:start] + result[start+end+1:]
+
+		log.Printf("Starting LMTP server at %s", ls.Addr)
+		go func() {
+			errc <- ls.Serve(&latencyListener{Listener: &transcriptListener{Listener: ll, name: "lmtp"}})
+		}()
 	}
 
-	return strings.TrimSpace(result)
+	return <-errc
+}
+
+// newSMTPServer applies the settings shared by every SMTP listener.
+func newSMTPServer(be *Backend) *smtp.Server {
+	s := smtp.NewServer(be)
+	s.Domain = smtpDomain
+	s.AllowInsecureAuth = !be.requireTLS
+	s.EnableSMTPUTF8 = true
+	s.EnableBINARYMIME = true
+
+	// Oversized messages get 552 and extra recipients 452 from go-smtp,
+	// which also advertises the limits through SIZE and LIMITS
+	s.MaxMessageBytes = int64(getEnvInt("SMTP_MAX_MESSAGE_BYTES", 25*1024*1024))
+	s.MaxRecipients = getEnvInt("SMTP_MAX_RECIPIENTS", 1000)
+	s.ReadTimeout = getEnvDuration("SMTP_READ_TIMEOUT", 5*time.Minute)
+	s.WriteTimeout = getEnvDuration("SMTP_WRITE_TIMEOUT", time.Minute)
+	return s
 }
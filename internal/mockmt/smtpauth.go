@@ -0,0 +1,288 @@
+package mockmt
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/gin-gonic/gin"
+)
+
+const cramMD5 = "CRAM-MD5"
+
+var errAuthRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Authentication required",
+}
+
+var errUnexpectedAuthStep = errors.New("unexpected authentication step")
+
+type SMTPCredential struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	Password  string    `json:"password,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *Session) AuthMechanisms() []string {
+	mechs := []string{sasl.Plain, sasl.Login}
+	if s.backend.authCRAMMD5 {
+		mechs = append(mechs, cramMD5)
+	}
+	return mechs
+}
+
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return s.authenticate(username, password)
+		}), nil
+	case sasl.Login:
+		return &loginServer{authenticate: s.authenticate}, nil
+	case cramMD5:
+		if s.backend.authCRAMMD5 {
+			return &cramMD5Server{challenge: cramMD5Challenge(), authenticate: s.authenticateCRAMMD5}, nil
+		}
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+// authenticate checks the credentials when authentication is enforced and
+// otherwise accepts anything, recording the identity either way.
+func (s *Session) authenticate(username, password string) (err error) {
+	defer func() { s.traceAuth(username, err) }()
+
+	if s.backend.authRequired {
+		stored, err := getSMTPPassword(username)
+		if err != nil || !hmac.Equal([]byte(stored), []byte(password)) {
+			return smtp.ErrAuthFailed
+		}
+	}
+	s.authUser = username
+	return nil
+}
+
+func (s *Session) authenticateCRAMMD5(username, digest, challenge string) (err error) {
+	defer func() { s.traceAuth(username, err) }()
+
+	if s.backend.authRequired {
+		stored, err := getSMTPPassword(username)
+		if err != nil {
+			return smtp.ErrAuthFailed
+		}
+		mac := hmac.New(md5.New, []byte(stored))
+		mac.Write([]byte(challenge))
+		expected := hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(expected), []byte(strings.ToLower(digest))) {
+			return smtp.ErrAuthFailed
+		}
+	}
+	s.authUser = username
+	return nil
+}
+
+func (s *Session) traceAuth(username string, err error) {
+	if s.transcript == nil {
+		return
+	}
+	s.trace("AUTH as "+username+" <credentials>", err)
+	if err == nil {
+		s.transcript.useExtensions("AUTH")
+	}
+}
+
+// loginServer implements the LOGIN mechanism, which go-sasl only provides
+// on the client side.
+type loginServer struct {
+	step         int
+	username     string
+	authenticate func(username, password string) error
+}
+
+func (a *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch a.step {
+	case 0:
+		a.step++
+		// Some clients send the username as initial response
+		if len(response) > 0 {
+			a.username = string(response)
+			a.step++
+			return []byte("Password:"), false, nil
+		}
+		return []byte("Username:"), false, nil
+	case 1:
+		a.username = string(response)
+		a.step++
+		return []byte("Password:"), false, nil
+	case 2:
+		a.step++
+		return nil, true, a.authenticate(a.username, string(response))
+	}
+	return nil, false, errUnexpectedAuthStep
+}
+
+type cramMD5Server struct {
+	challenge    string
+	sent         bool
+	authenticate func(username, digest, challenge string) error
+}
+
+func (a *cramMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if !a.sent {
+		if len(response) > 0 {
+			return nil, false, errUnexpectedAuthStep
+		}
+		a.sent = true
+		return []byte(a.challenge), false, nil
+	}
+
+	parts := strings.Fields(string(response))
+	if len(parts) != 2 {
+		return nil, false, smtp.ErrAuthFailed
+	}
+	return nil, true, a.authenticate(parts[0], parts[1], a.challenge)
+}
+
+func cramMD5Challenge() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("<%x.%d@localhost>", b, time.Now().Unix())
+}
+
+func generatePassword() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func getSMTPPassword(username string) (string, error) {
+	var password string
+	err := db.QueryRow("SELECT password FROM smtp_credentials WHERE username = ?", username).Scan(&password)
+	return password, err
+}
+
+func getSMTPCredentialsByUser(userID int) ([]SMTPCredential, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, username, created_at
+		FROM smtp_credentials
+		WHERE user_id = ?
+		ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []SMTPCredential{}
+	for rows.Next() {
+		var cred SMTPCredential
+		if err := rows.Scan(&cred.ID, &cred.UserID, &cred.Username, &cred.CreatedAt); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, cred)
+	}
+
+	return credentials, nil
+}
+
+func createSMTPCredential(userID int, username, password string) (*SMTPCredential, error) {
+	result, err := db.Exec(`
+		INSERT INTO smtp_credentials (user_id, username, password)
+		VALUES (?, ?, ?)
+	`, userID, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SMTPCredential{
+		ID:        int(id),
+		UserID:    userID,
+		Username:  username,
+		Password:  password,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+func deleteSMTPCredential(id, userID int) error {
+	result, err := db.Exec("DELETE FROM smtp_credentials WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func handleGetSMTPCredentials(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	credentials, err := getSMTPCredentialsByUser(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SMTP credentials"})
+		return
+	}
+
+	c.JSON(http.StatusOK, credentials)
+}
+
+// handleCreateSMTPCredential returns the password only in this response. The
+// username defaults to the user's email and the password is generated when
+// not given.
+func handleCreateSMTPCredential(c *gin.Context) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Username == "" {
+		req.Username = c.GetString("user_email")
+	}
+	if req.Password == "" {
+		req.Password = generatePassword()
+	}
+
+	cred, err := createSMTPCredential(c.GetInt("user_id"), req.Username, req.Password)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Failed to create SMTP credential, username may already exist"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, cred)
+}
+
+func handleDeleteSMTPCredential(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential ID"})
+		return
+	}
+
+	if err := deleteSMTPCredential(id, c.GetInt("user_id")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SMTP credential not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "SMTP credential deleted successfully"})
+}
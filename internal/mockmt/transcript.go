@@ -0,0 +1,716 @@
+package mockmt
+
+import (
+	"bytes"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	transcriptClient = "client"
+	transcriptServer = "server"
+	transcriptInfo   = "info"
+
+	// Longest line and largest number of lines kept per connection
+	maxTranscriptLine  = 4096
+	maxTranscriptLines = 10000
+)
+
+// Transcript is the recorded SMTP dialogue of one client connection.
+type Transcript struct {
+	ID            int              `json:"id"`
+	Listener      string           `json:"listener"`
+	ClientIP      string           `json:"client_ip"`
+	Helo          string           `json:"helo"`
+	Extensions    []string         `json:"extensions"`
+	TLSVersion    string           `json:"tls_version,omitempty"`
+	TLSCipher     string           `json:"tls_cipher,omitempty"`
+	TLSServerName string           `json:"tls_server_name,omitempty"`
+	StartedAt     time.Time        `json:"started_at"`
+	EndedAt       *time.Time       `json:"ended_at,omitempty"`
+	EmailIDs      []int            `json:"email_ids"`
+	Lines         []TranscriptLine `json:"lines,omitempty"`
+}
+
+// TranscriptLine is one line of the dialogue, OffsetMs after the connection
+// was accepted.
+type TranscriptLine struct {
+	OffsetMs  int64  `json:"offset_ms"`
+	Direction string `json:"direction"`
+	Text      string `json:"text"`
+}
+
+// transcriptRecorder follows the bytes of a connection and turns them into
+// transcript lines. Message data is summarized and credentials are redacted.
+// Once the connection is encrypted the bytes cannot be read any more, and the
+// session records the commands it handles instead.
+type transcriptRecorder struct {
+	mu         sync.Mutex
+	t          Transcript
+	encrypted  bool
+	clientBuf  []byte
+	serverBuf  []byte
+	dataMode   bool // reading DATA content until the final "."
+	dataBytes  int
+	bdatLeft   int // chunk bytes still to come after a BDAT command
+	bdatSize   int
+	redactNext bool // the next client line answers an AUTH challenge
+	startTLS   bool // STARTTLS was requested and not answered yet
+	mailLine   int  // position of the MAIL command of the current transaction
+	saved      int  // lines already written to the database
+}
+
+// transcripts maps the remote address of live connections to their recorder,
+// so sessions can find the recorder of their connection.
+var transcripts sync.Map
+
+func transcriptFor(addr net.Addr) *transcriptRecorder {
+	if rec, ok := transcripts.Load(addr.String()); ok {
+		return rec.(*transcriptRecorder)
+	}
+	return nil
+}
+
+// transcriptListener records the dialogue of every accepted connection when
+// SMTP_TRANSCRIPTS is enabled. With encrypted set the connections are
+// wrapped in TLS above this listener, as for SMTPS.
+type transcriptListener struct {
+	net.Listener
+	name      string
+	encrypted bool
+}
+
+func (l *transcriptListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil || getEnv("SMTP_TRANSCRIPTS", "true") != "true" {
+		return c, err
+	}
+
+	rec := &transcriptRecorder{
+		t: Transcript{
+			Listener:  l.name,
+			StartedAt: time.Now(),
+		},
+		encrypted: l.encrypted,
+	}
+	return &transcriptConn{Conn: c, rec: rec}, nil
+}
+
+type transcriptConn struct {
+	net.Conn
+	rec       *transcriptRecorder
+	startOnce sync.Once
+	started   bool
+	closeOnce sync.Once
+}
+
+// start creates the transcript on first use of the connection rather than
+// in Accept, as the client address is only known once a PROXY protocol
+// header has been read.
+func (c *transcriptConn) start() bool {
+	c.startOnce.Do(func() {
+		addr := c.Conn.RemoteAddr()
+		c.rec.t.ClientIP = remoteIP(addr)
+		if err := createTranscript(&c.rec.t); err != nil {
+			log.Printf("Error creating SMTP transcript: %v", err)
+			return
+		}
+		c.rec.add(transcriptInfo, fmt.Sprintf("Connection from %s", addr))
+		if c.rec.encrypted {
+			c.rec.add(transcriptInfo, "Implicit TLS, commands below are recorded from the session")
+		}
+
+		transcripts.Store(addr.String(), c.rec)
+		c.started = true
+	})
+	return c.started
+}
+
+func (c *transcriptConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.start() {
+		c.rec.clientData(b[:n])
+	}
+	return n, err
+}
+
+func (c *transcriptConn) Write(b []byte) (int, error) {
+	if c.start() {
+		c.rec.serverData(b)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *transcriptConn) Close() error {
+	c.closeOnce.Do(func() {
+		// Connections closed before any traffic get no transcript
+		c.startOnce.Do(func() {})
+		if c.started {
+			transcripts.Delete(c.Conn.RemoteAddr().String())
+			c.rec.finish()
+		}
+	})
+	return c.Conn.Close()
+}
+
+func (r *transcriptRecorder) add(direction, text string) {
+	if len(r.t.Lines) >= maxTranscriptLines {
+		return
+	}
+	if len(r.t.Lines) == maxTranscriptLines-1 {
+		direction, text = transcriptInfo, "Transcript truncated"
+	}
+	r.t.Lines = append(r.t.Lines, TranscriptLine{
+		OffsetMs:  time.Since(r.t.StartedAt).Milliseconds(),
+		Direction: direction,
+		Text:      text,
+	})
+}
+
+// nextLine splits the first complete line off b, keeping incomplete lines
+// in buf. It returns the line without its CRLF and its size on the wire.
+func nextLine(buf *[]byte, b []byte) (line string, size int, rest []byte, ok bool) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		if room := maxTranscriptLine - len(*buf); room > 0 {
+			*buf = append(*buf, b[:min(room, len(b))]...)
+		}
+		return "", 0, nil, false
+	}
+
+	size = len(*buf) + i + 1
+	full := append(*buf, b[:min(i, max(maxTranscriptLine-len(*buf), 0))]...)
+	*buf = (*buf)[:0]
+	return strings.TrimSuffix(string(full), "\r"), size, b[i+1:], true
+}
+
+func (r *transcriptRecorder) clientData(b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.save(false)
+
+	for len(b) > 0 && !r.encrypted {
+		if r.bdatLeft > 0 {
+			n := min(len(b), r.bdatLeft)
+			r.bdatLeft -= n
+			b = b[n:]
+			if r.bdatLeft == 0 {
+				r.add(transcriptClient, fmt.Sprintf("<%d bytes of chunk data>", r.bdatSize))
+			}
+			continue
+		}
+
+		line, size, rest, ok := nextLine(&r.clientBuf, b)
+		if !ok {
+			return
+		}
+		b = rest
+		r.clientLine(line, size)
+	}
+}
+
+func (r *transcriptRecorder) clientLine(line string, size int) {
+	if r.dataMode {
+		if line == "." {
+			r.add(transcriptClient, fmt.Sprintf("<%d bytes of message data>", r.dataBytes))
+			r.add(transcriptClient, ".")
+			r.dataMode = false
+			r.dataBytes = 0
+		} else {
+			r.dataBytes += size
+		}
+		return
+	}
+	if r.redactNext {
+		r.redactNext = false
+		r.add(transcriptClient, "<credentials>")
+		return
+	}
+
+	verb, args, _ := strings.Cut(line, " ")
+	switch strings.ToUpper(verb) {
+	case "AUTH":
+		if fields := strings.Fields(args); len(fields) > 1 {
+			line = verb + " " + fields[0] + " <credentials>"
+		}
+	case "BDAT":
+		if fields := strings.Fields(args); len(fields) > 0 {
+			if n, err := strconv.Atoi(fields[0]); err == nil && n > 0 {
+				r.bdatLeft = n
+				r.bdatSize = n
+			}
+		}
+	case "MAIL":
+		r.mailLine = len(r.t.Lines)
+	case "STARTTLS":
+		r.startTLS = true
+	}
+	r.add(transcriptClient, line)
+}
+
+func (r *transcriptRecorder) serverData(b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.save(false)
+
+	for len(b) > 0 && !r.encrypted {
+		line, _, rest, ok := nextLine(&r.serverBuf, b)
+		if !ok {
+			return
+		}
+		b = rest
+
+		r.add(transcriptServer, line)
+		switch {
+		case strings.HasPrefix(line, "354"):
+			r.dataMode = true
+		case strings.HasPrefix(line, "334"):
+			r.redactNext = true
+		case strings.HasPrefix(line, "220 ") && r.startTLS:
+			r.encrypted = true
+			r.useExtension("STARTTLS")
+			r.add(transcriptInfo, "TLS handshake, commands below are recorded from the session")
+		}
+		r.startTLS = false
+	}
+}
+
+// session records what a new session knows about its connection: the
+// HELO/EHLO name and the TLS state.
+func (r *transcriptRecorder) session(c *smtp.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.save(false)
+
+	r.t.Helo = c.Hostname()
+	if state, ok := c.TLSConnectionState(); ok {
+		r.t.TLSVersion = tls.VersionName(state.Version)
+		r.t.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+		r.t.TLSServerName = state.ServerName
+	}
+	if r.encrypted {
+		r.add(transcriptClient, "EHLO "+c.Hostname())
+	}
+}
+
+// command records a command handled by the session and its replies, one per
+// error with nil for success, while the connection bytes cannot be read.
+func (r *transcriptRecorder) command(command string, replies ...error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.save(false)
+
+	if !r.encrypted {
+		return
+	}
+	if startsTransaction(command) {
+		r.mailLine = len(r.t.Lines)
+	}
+	r.add(transcriptClient, command)
+	for _, err := range replies {
+		r.add(transcriptServer, replyText(err))
+	}
+}
+
+// transactionStart returns the position of the MAIL command of the current
+// transaction.
+func (r *transcriptRecorder) transactionStart() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.mailLine
+}
+
+func (r *transcriptRecorder) useExtensions(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, name := range names {
+		r.useExtension(name)
+	}
+}
+
+func (r *transcriptRecorder) useExtension(name string) {
+	for _, ext := range r.t.Extensions {
+		if ext == name {
+			return
+		}
+	}
+	r.t.Extensions = append(r.t.Extensions, name)
+}
+
+func (r *transcriptRecorder) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.dataMode {
+		r.add(transcriptInfo, fmt.Sprintf("Connection closed during DATA after %d bytes", r.dataBytes))
+	} else if r.bdatLeft > 0 {
+		r.add(transcriptInfo, fmt.Sprintf("Connection closed during BDAT with %d bytes missing", r.bdatLeft))
+	} else if len(r.clientBuf) > 0 {
+		r.add(transcriptClient, string(r.clientBuf))
+	}
+	r.add(transcriptInfo, "Connection closed")
+	r.save(true)
+}
+
+// save queues the lines recorded since the last save to be written by
+// saveTranscripts, so that the transcript of a live connection can be read
+// and survives a crash, and marks it ended once the connection is closed. It
+// must be called with r.mu held.
+func (r *transcriptRecorder) save(ended bool) {
+	if r.saved == len(r.t.Lines) && !ended {
+		return
+	}
+
+	t := r.t
+	t.Extensions = append([]string(nil), r.t.Extensions...)
+	t.Lines = append([]TranscriptLine(nil), r.t.Lines[r.saved:]...)
+	if ended {
+		now := time.Now()
+		t.EndedAt = &now
+	}
+	transcriptWriterOnce.Do(func() { go saveTranscripts() })
+	transcriptWrites <- transcriptWrite{t: t, from: r.saved}
+	r.saved = len(r.t.Lines)
+}
+
+func replyText(err error) string {
+	if err == nil {
+		return "250 2.0.0 OK"
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		code := smtpErr.EnhancedCode
+		return fmt.Sprintf("%d %d.%d.%d %s", smtpErr.Code, code[0], code[1], code[2], smtpErr.Message)
+	}
+	return "554 5.0.0 " + err.Error()
+}
+
+func createTranscript(t *Transcript) error {
+	result, err := db.Exec(`
+		INSERT INTO smtp_transcripts (listener, client_ip, started_at)
+		VALUES (?, ?, ?)
+	`, t.Listener, t.ClientIP, t.StartedAt)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	t.ID = int(id)
+	return nil
+}
+
+// transcriptWrite is the connection details of a transcript along with its
+// lines from position from on.
+type transcriptWrite struct {
+	t    Transcript
+	from int
+}
+
+// transcriptWrites queues transcript lines for one writer, rather than each
+// connection waiting on a transaction of its own for every line.
+var (
+	transcriptWrites     = make(chan transcriptWrite, 1000)
+	transcriptWriterOnce sync.Once
+)
+
+// saveTranscripts writes queued transcript lines, all of those waiting at
+// once in one transaction.
+func saveTranscripts() {
+	for w := range transcriptWrites {
+		batch := []transcriptWrite{w}
+	queued:
+		for len(batch) < cap(transcriptWrites) {
+			select {
+			case w := <-transcriptWrites:
+				batch = append(batch, w)
+			default:
+				break queued
+			}
+		}
+
+		if err := saveTranscriptBatch(batch); err != nil {
+			log.Printf("Error saving SMTP transcripts: %v", err)
+		}
+	}
+}
+
+func saveTranscriptBatch(batch []transcriptWrite) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, w := range batch {
+		t := w.t
+		_, err = tx.Exec(`
+			UPDATE smtp_transcripts
+			SET helo = ?, extensions = ?, tls_version = ?, tls_cipher = ?, tls_server_name = ?, ended_at = ?
+			WHERE id = ?
+		`, t.Helo, strings.Join(t.Extensions, ","), t.TLSVersion, t.TLSCipher, t.TLSServerName, t.EndedAt, t.ID)
+		if err != nil {
+			return err
+		}
+
+		for i, line := range t.Lines {
+			_, err = tx.Exec(`
+				INSERT INTO smtp_transcript_lines (transcript_id, position, offset_ms, direction, text)
+				VALUES (?, ?, ?, ?, ?)
+			`, t.ID, w.from+i, line.OffsetMs, line.Direction, line.Text)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+const transcriptColumns = `
+	t.id, t.listener, t.client_ip, COALESCE(t.helo, ''), COALESCE(t.extensions, ''),
+	COALESCE(t.tls_version, ''), COALESCE(t.tls_cipher, ''), COALESCE(t.tls_server_name, ''),
+	t.started_at, t.ended_at, COALESCE((SELECT GROUP_CONCAT(e.id) FROM emails e WHERE e.transcript_id = t.id), '')
+`
+
+func scanTranscript(row interface{ Scan(...any) error }) (*Transcript, error) {
+	var t Transcript
+	var extensions, emailIDs string
+	var endedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.Listener, &t.ClientIP, &t.Helo, &extensions,
+		&t.TLSVersion, &t.TLSCipher, &t.TLSServerName, &t.StartedAt, &endedAt, &emailIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Extensions = []string{}
+	if extensions != "" {
+		t.Extensions = strings.Split(extensions, ",")
+	}
+	if endedAt.Valid {
+		t.EndedAt = &endedAt.Time
+	}
+	t.EmailIDs = []int{}
+	for _, id := range strings.Split(emailIDs, ",") {
+		if n, err := strconv.Atoi(id); err == nil {
+			t.EmailIDs = append(t.EmailIDs, n)
+		}
+	}
+	return &t, nil
+}
+
+// getTranscripts lists the most recent transcripts, optionally only those of
+// one client IP or those that produced no email.
+func getTranscripts(clientIP string, rejectedOnly bool, limit int) ([]Transcript, error) {
+	query := `SELECT ` + transcriptColumns + ` FROM smtp_transcripts t WHERE 1 = 1`
+	args := []any{}
+	if clientIP != "" {
+		query += ` AND t.client_ip = ?`
+		args = append(args, clientIP)
+	}
+	if rejectedOnly {
+		query += ` AND NOT EXISTS (SELECT 1 FROM emails e WHERE e.transcript_id = t.id)`
+	}
+	query += ` ORDER BY t.id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transcripts := []Transcript{}
+	for rows.Next() {
+		t, err := scanTranscript(rows)
+		if err != nil {
+			return nil, err
+		}
+		transcripts = append(transcripts, *t)
+	}
+
+	return transcripts, nil
+}
+
+func getTranscript(id int) (*Transcript, error) {
+	t, err := scanTranscript(db.QueryRow(`SELECT `+transcriptColumns+` FROM smtp_transcripts t WHERE t.id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+
+	t.Lines, err = getTranscriptLines(id, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// getEmailTranscript returns the transcript of the connection an email was
+// received on, with only the lines of the email's own transaction, as the
+// other transactions of the connection may be addressed to other users.
+func getEmailTranscript(emailID int) (*Transcript, error) {
+	var id int
+	var position sql.NullInt64
+	err := db.QueryRow(`SELECT COALESCE(transcript_id, 0), transcript_position FROM emails WHERE id = ?`, emailID).Scan(&id, &position)
+	if err != nil {
+		return nil, err
+	}
+	// Emails received before transaction positions were recorded cannot be
+	// told apart from the others of their connection
+	if id == 0 || !position.Valid {
+		return nil, sql.ErrNoRows
+	}
+
+	t, err := scanTranscript(db.QueryRow(`SELECT `+transcriptColumns+` FROM smtp_transcripts t WHERE t.id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	t.EmailIDs = []int{emailID}
+	t.Lines, err = getTranscriptLines(id, int(position.Int64), true)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// getTranscriptLines returns the lines of a transcript from position from on.
+// With transaction set, it stops before the client starts another
+// transaction with MAIL or RSET.
+func getTranscriptLines(id, from int, transaction bool) ([]TranscriptLine, error) {
+	rows, err := db.Query(`
+		SELECT offset_ms, direction, text
+		FROM smtp_transcript_lines
+		WHERE transcript_id = ? AND position >= ?
+		ORDER BY position
+	`, id, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []TranscriptLine{}
+	for rows.Next() {
+		var line TranscriptLine
+		if err := rows.Scan(&line.OffsetMs, &line.Direction, &line.Text); err != nil {
+			return nil, err
+		}
+		if transaction && len(lines) > 0 && line.Direction == transcriptClient && startsTransaction(line.Text) {
+			break
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
+
+// startsTransaction tells whether a client line ends the current mail
+// transaction and possibly starts a new one.
+func startsTransaction(line string) bool {
+	verb, _, _ := strings.Cut(line, " ")
+	return strings.EqualFold(verb, "MAIL") || strings.EqualFold(verb, "RSET")
+}
+
+func clearTranscripts() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Transcripts of live connections are kept whole, as they are still
+	// being written
+	const ended = `SELECT id FROM smtp_transcripts WHERE ended_at IS NOT NULL`
+	if _, err := tx.Exec("DELETE FROM smtp_transcript_lines WHERE transcript_id IN (" + ended + ")"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE emails SET transcript_id = NULL WHERE transcript_id IN (" + ended + ")"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM smtp_transcripts WHERE ended_at IS NOT NULL"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func handleGetEmailTranscript(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	emailID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email ID"})
+		return
+	}
+
+	email, err := getEmailByID(emailID, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+	if email.TranscriptID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No transcript recorded for this email"})
+		return
+	}
+
+	transcript, err := getEmailTranscript(email.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transcript not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, transcript)
+}
+
+func handleGetTranscripts(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	transcripts, err := getTranscripts(c.Query("client_ip"), c.Query("rejected") == "true", limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get transcripts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, transcripts)
+}
+
+func handleGetTranscript(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transcript ID"})
+		return
+	}
+
+	transcript, err := getTranscript(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transcript not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, transcript)
+}
+
+func handleClearTranscripts(c *gin.Context) {
+	if err := clearTranscripts(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear transcripts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Transcripts cleared successfully"})
+}
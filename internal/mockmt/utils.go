@@ -2,8 +2,12 @@ package mockmt
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
+	"log"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,6 +19,68 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid number for %s: %q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s: %q, using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+// matchPattern reports whether value matches the case-insensitive glob
+// pattern, e.g. "*@example.com". An empty pattern matches everything.
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return err == nil && matched
+}
+
+// loadRulesFromEnv decodes a JSON array from the file named by the fileKey
+// variable, followed by the inline JSON array in the inlineKey variable.
+func loadRulesFromEnv[T any](fileKey, inlineKey string) ([]T, error) {
+	var rules []T
+
+	if path := getEnv(fileKey, ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", fileKey, err)
+		}
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", fileKey, err)
+		}
+	}
+
+	if inline := getEnv(inlineKey, ""); inline != "" {
+		var more []T
+		if err := json.Unmarshal([]byte(inline), &more); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", inlineKey, err)
+		}
+		rules = append(rules, more...)
+	}
+
+	return rules, nil
+}
+
 func generateMessageID() string {
 	// Generate a random message ID
 	b := make([]byte, 16)
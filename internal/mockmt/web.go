@@ -1,8 +1,10 @@
 package mockmt
 
 import (
+	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"strconv"
 
@@ -26,9 +28,49 @@ func StartWebServer() error {
 	{
 		api.GET("/user", handleGetUser)
 		api.GET("/emails", handleGetEmails)
+		api.GET("/emails/wait", handleWaitForEmail)
 		api.GET("/emails/:id", handleGetEmail)
+		api.GET("/emails/:id/raw", handleGetEmailRaw)
+		api.GET("/emails/:id/headers", handleGetEmailHeaders)
+		api.GET("/emails/:id/parts", handleGetEmailParts)
+		api.GET("/emails/:id/transcript", handleGetEmailTranscript)
+		api.GET("/emails/:id/attachments/:aid", handleGetAttachment)
+		api.POST("/emails/:id/release", handleReleaseEmail)
 		api.DELETE("/emails/:id", handleDeleteEmail)
+		api.GET("/search", handleSearch)
 		api.GET("/stats", handleGetStats)
+		api.GET("/smtp-credentials", handleGetSMTPCredentials)
+		api.POST("/smtp-credentials", handleCreateSMTPCredential)
+		api.DELETE("/smtp-credentials/:id", handleDeleteSMTPCredential)
+	}
+
+	admin := r.Group("/api/admin")
+	admin.Use(adminMiddleware())
+	{
+		admin.GET("/faults", handleGetFaultRules)
+		admin.POST("/faults", handleCreateFaultRule)
+		admin.DELETE("/faults", handleClearFaultRules)
+		admin.DELETE("/faults/:id", handleDeleteFaultRule)
+		admin.GET("/latency", handleGetLatencyRules)
+		admin.POST("/latency", handleCreateLatencyRule)
+		admin.DELETE("/latency", handleClearLatencyRules)
+		admin.DELETE("/latency/:id", handleDeleteLatencyRule)
+		admin.DELETE("/greylist", handleClearGreylist)
+		admin.GET("/routes", handleGetRoutingRules)
+		admin.POST("/routes", handleCreateRoutingRule)
+		admin.DELETE("/routes", handleClearRoutingRules)
+		admin.DELETE("/routes/:id", handleDeleteRoutingRule)
+		admin.GET("/relay", handleGetRelayRules)
+		admin.POST("/relay", handleCreateRelayRule)
+		admin.DELETE("/relay", handleClearRelayRules)
+		admin.DELETE("/relay/:id", handleDeleteRelayRule)
+		admin.GET("/dns", handleGetDNSRecords)
+		admin.POST("/dns", handleCreateDNSRecord)
+		admin.DELETE("/dns", handleClearDNSRecords)
+		admin.DELETE("/dns/:id", handleDeleteDNSRecord)
+		admin.GET("/transcripts", handleGetTranscripts)
+		admin.GET("/transcripts/:id", handleGetTranscript)
+		admin.DELETE("/transcripts", handleClearTranscripts)
 	}
 
 	if getEnv("SERVE_FRONTEND_DIST", "") == "true" {
@@ -89,14 +131,19 @@ func handleGetUser(c *gin.Context) {
 
 func handleGetEmails(c *gin.Context) {
 	userID := c.GetInt("user_id")
-	emails, err := getEmailsByUser(userID)
+	filter, err := parseEmailFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, err := listEmails(userID, filter)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get emails"})
 		return
 	}
-	log.Printf("Emails: %+v", emails)
 
-	c.JSON(http.StatusOK, emails)
+	c.JSON(http.StatusOK, page)
 }
 
 func handleGetEmail(c *gin.Context) {
@@ -113,9 +160,110 @@ func handleGetEmail(c *gin.Context) {
 		return
 	}
 
+	if !email.IsRead {
+		if err := markEmailRead(emailID, userID); err != nil {
+			log.Printf("Error marking email %d as read: %v", emailID, err)
+		}
+		email.IsRead = true
+	}
+
 	c.JSON(http.StatusOK, email)
 }
 
+func handleGetEmailRaw(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	emailID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email ID"})
+		return
+	}
+
+	raw, err := getEmailRaw(emailID, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+	// Emails stored before raw messages were kept have none
+	if len(raw) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Raw message not available for this email"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"email-%d.eml\"", emailID))
+	c.Data(http.StatusOK, "message/rfc822", raw)
+}
+
+func handleGetEmailHeaders(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	emailID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email ID"})
+		return
+	}
+
+	if _, err := getEmailByID(emailID, userID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+
+	headers, err := getEmailHeaders(emailID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get headers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, headers)
+}
+
+func handleGetEmailParts(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	emailID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email ID"})
+		return
+	}
+
+	if _, err := getEmailByID(emailID, userID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+
+	parts, err := getEmailParts(emailID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get MIME parts"})
+		return
+	}
+	if parts == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "MIME structure not recorded for this email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, parts)
+}
+
+func handleGetAttachment(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	emailID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email ID"})
+		return
+	}
+	attachmentID, err := strconv.Atoi(c.Param("aid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+		return
+	}
+
+	attachment, err := getAttachment(attachmentID, emailID, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	c.Data(http.StatusOK, attachment.ContentType, attachment.Data)
+}
+
 func handleDeleteEmail(c *gin.Context) {
 	userID := c.GetInt("user_id")
 	emailID, err := strconv.Atoi(c.Param("id"))
@@ -61,7 +61,7 @@ echo "🎉 Setup completed successfully!"
 echo ""
 echo "📋 Next steps:"
 echo "1. Edit .env file with your Google OAuth credentials"
-echo "2. Run 'go run .' to start the backend"
+echo "2. Run 'go run -tags sqlite_fts5 .' to start the backend"
 echo "3. Run 'cd frontend && npm run dev' to start the frontend"
 echo "4. Access the application at http://localhost:3000"
 echo ""